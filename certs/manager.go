@@ -0,0 +1,212 @@
+package certs
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiggoins/port-allocator/k8s"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// CACertKey is the key of the CA bundle in the certificate Secret
+	CACertKey = "ca.crt"
+
+	// checkPeriod is how often the Secret is re-read to pick up rotations by other replicas
+	checkPeriod = time.Hour
+)
+
+// Config describes where the bootstrapped certificate is kept and who it is for
+type Config struct {
+	// Namespace and ServiceName of the Service fronting the webhook
+	Namespace   string
+	ServiceName string
+	// SecretName is the Secret holding the CA and serving certificate
+	SecretName string
+	// WebhookConfigName names the Mutating and ValidatingWebhookConfiguration whose caBundle is injected
+	WebhookConfigName string
+	// Validity of a newly generated certificate
+	Validity time.Duration
+	// RotateBefore is how long before expiry a new certificate is generated
+	RotateBefore time.Duration
+}
+
+// Manager generates the serving certificate of the webhook, stores it in a Secret shared
+// by all replicas and keeps the caBundle of the webhook configuration in sync
+type Manager struct {
+	client   kubernetes.Interface
+	config   Config
+	current  atomic.Pointer[tls.Certificate]
+	caBundle atomic.Pointer[[]byte]
+}
+
+func NewManager(client kubernetes.Interface, config Config) *Manager {
+	return &Manager{client: client, config: config}
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (m *Manager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert := m.current.Load()
+	if cert == nil {
+		return nil, fmt.Errorf("serving certificate is not ready")
+	}
+	return cert, nil
+}
+
+// CABundle returns the CA bundle clients should trust, nil until a certificate is loaded
+func (m *Manager) CABundle() []byte {
+	if ca := m.caBundle.Load(); ca != nil {
+		return *ca
+	}
+	return nil
+}
+
+// Run ensures a valid certificate is loaded, then periodically rotates it until stopCh is closed
+func (m *Manager) Run(ctx context.Context, stopCh <-chan struct{}) error {
+	if err := m.ensure(ctx); err != nil {
+		return err
+	}
+
+	go wait.Until(func() {
+		if err := m.ensure(ctx); err != nil {
+			klog.Errorf("failed to rotate serving certificate: %v", err)
+		}
+	}, m.checkPeriod(), stopCh)
+
+	return nil
+}
+
+func (m *Manager) checkPeriod() time.Duration {
+	if m.config.RotateBefore > 0 && m.config.RotateBefore/2 < checkPeriod {
+		return m.config.RotateBefore / 2
+	}
+	return checkPeriod
+}
+
+// ensure loads the certificate from the Secret, generating a new one when it is missing
+// or about to expire. The CA is injected into the webhook configuration before the new
+// certificate is served.
+func (m *Manager) ensure(ctx context.Context) error {
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+
+	secret, err := secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return fmt.Errorf("get secret %s/%s: %v", m.config.Namespace, m.config.SecretName, err)
+	}
+	if apierrors.IsNotFound(err) {
+		secret = nil
+	}
+
+	if secret == nil || m.needsRotation(secret) {
+		secret, err = m.rotate(ctx, secret)
+		if err != nil {
+			return err
+		}
+	}
+
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		return fmt.Errorf("load key pair from secret %s/%s: %v", m.config.Namespace, m.config.SecretName, err)
+	}
+	// caBundle同时包含新旧CA，先注入再切换证书，apiserver在切换前后都能校验
+	caBundle := secret.Data[CACertKey]
+	m.caBundle.Store(&caBundle)
+	old := m.current.Load()
+	if err := m.injectCABundle(ctx, caBundle); err != nil {
+		if old != nil {
+			return fmt.Errorf("keep serving the current certificate, injecting the new caBundle failed: %v", err)
+		}
+		m.current.Store(&cert)
+		return err
+	}
+
+	if old == nil || !bytes.Equal(old.Certificate[0], cert.Certificate[0]) {
+		logCertificate(fmt.Sprintf("secret %s/%s", m.config.Namespace, m.config.SecretName), &cert)
+	}
+	m.current.Store(&cert)
+
+	return nil
+}
+
+func (m *Manager) needsRotation(secret *corev1.Secret) bool {
+	cert, err := tls.X509KeyPair(secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey])
+	if err != nil {
+		klog.Warningf("secret %s/%s holds an invalid key pair, regenerating: %v", m.config.Namespace, m.config.SecretName, err)
+		return true
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return true
+	}
+	return time.Now().Add(m.config.RotateBefore).After(leaf.NotAfter)
+}
+
+// rotate writes a new key pair into the Secret. Updates are checked against the
+// resourceVersion, so when several replicas race only one of them wins and the
+// others pick up its certificate.
+func (m *Manager) rotate(ctx context.Context, secret *corev1.Secret) (*corev1.Secret, error) {
+	dnsNames := []string{
+		m.config.ServiceName,
+		fmt.Sprintf("%s.%s", m.config.ServiceName, m.config.Namespace),
+		fmt.Sprintf("%s.%s.svc", m.config.ServiceName, m.config.Namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", m.config.ServiceName, m.config.Namespace),
+	}
+	pair, err := generateKeyPair(dnsNames[2], dnsNames, m.config.Validity)
+	if err != nil {
+		return nil, err
+	}
+	klog.Infof("generated new serving certificate for %v", dnsNames)
+
+	secrets := m.client.CoreV1().Secrets(m.config.Namespace)
+	if secret == nil {
+		secret = &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: m.config.SecretName, Namespace: m.config.Namespace},
+			Type:       corev1.SecretTypeTLS,
+			Data: map[string][]byte{
+				corev1.TLSCertKey:       pair.cert,
+				corev1.TLSPrivateKeyKey: pair.key,
+				CACertKey:               pair.ca,
+			},
+		}
+		created, err := secrets.Create(ctx, secret, metav1.CreateOptions{})
+		if apierrors.IsAlreadyExists(err) {
+			return secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+		}
+		return created, err
+	}
+
+	secret = secret.DeepCopy()
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	secret.Data[CACertKey] = appendUnexpiredCAs(pair.ca, secret.Data[CACertKey])
+	secret.Data[corev1.TLSCertKey] = pair.cert
+	secret.Data[corev1.TLSPrivateKeyKey] = pair.key
+	updated, err := secrets.Update(ctx, secret, metav1.UpdateOptions{})
+	if apierrors.IsConflict(err) {
+		return secrets.Get(ctx, m.config.SecretName, metav1.GetOptions{})
+	}
+	return updated, err
+}
+
+// injectCABundle sets caBundle on every webhook of the Mutating and ValidatingWebhookConfiguration
+func (m *Manager) injectCABundle(ctx context.Context, caBundle []byte) error {
+	if m.config.WebhookConfigName == "" {
+		return nil
+	}
+
+	if err := k8s.MutatingWebhookConfigs(m.client).InjectCABundle(ctx, m.config.WebhookConfigName, caBundle); err != nil {
+		return err
+	}
+	return k8s.ValidatingWebhookConfigs(m.client).InjectCABundle(ctx, m.config.WebhookConfigName, caBundle)
+}
@@ -0,0 +1,85 @@
+package certs
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+)
+
+// reloadPeriod is how often the certificate files are checked for changes
+const reloadPeriod = 10 * time.Second
+
+// KeyPairReloader serves a certificate from files on disk and reloads it when they change.
+// The files are re-read rather than watched for events, which also catches the symlink
+// swaps kubelet does when a projected Secret is updated.
+type KeyPairReloader struct {
+	certFile string
+	keyFile  string
+	certPEM  []byte
+	keyPEM   []byte
+	current  atomic.Pointer[tls.Certificate]
+}
+
+// NewKeyPairReloader loads the key pair from certFile and keyFile
+func NewKeyPairReloader(certFile, keyFile string) (*KeyPairReloader, error) {
+	r := &KeyPairReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate can be used as tls.Config.GetCertificate
+func (r *KeyPairReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return r.current.Load(), nil
+}
+
+// Run checks the files for changes until stopCh is closed
+func (r *KeyPairReloader) Run(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		if err := r.reload(); err != nil {
+			klog.Errorf("failed to reload serving certificate, keep serving the old one: %v", err)
+		}
+	}, reloadPeriod, stopCh)
+}
+
+func (r *KeyPairReloader) reload() error {
+	certPEM, err := os.ReadFile(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyPEM, err := os.ReadFile(r.keyFile)
+	if err != nil {
+		return err
+	}
+	if bytes.Equal(certPEM, r.certPEM) && bytes.Equal(keyPEM, r.keyPEM) {
+		return nil
+	}
+
+	// cert and key may be caught in the middle of an update, only swap once they match
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return fmt.Errorf("load key pair %s, %s: %v", r.certFile, r.keyFile, err)
+	}
+
+	r.certPEM, r.keyPEM = certPEM, keyPEM
+	r.current.Store(&cert)
+	logCertificate(r.certFile, &cert)
+
+	return nil
+}
+
+func logCertificate(source string, cert *tls.Certificate) {
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return
+	}
+	klog.Infof("serving certificate loaded from %s, subject %q expires at %s", source, leaf.Subject.CommonName, leaf.NotAfter)
+}
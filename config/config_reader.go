@@ -3,10 +3,13 @@ package config
 import (
 	"fmt"
 	"os"
+	"path"
+	"sort"
 	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/klog/v2"
 )
 
@@ -15,89 +18,491 @@ const (
 	NodePortMaxPort int64 = 32767
 )
 
-type Items map[string][]Item
+// File is the layout of port-range.yaml with global settings, the groups may also be
+// given directly at the top level as in earlier versions
+type File struct {
+	// Reserved 中的端口不会分配给任何namespace
+	Reserved string `yaml:"reserved"`
+	// Default 为没有被任何组匹配的namespace的策略
+	Default Default `yaml:"default"`
+	Groups  Items   `yaml:"groups"`
+}
+
+// Default is the policy for namespaces matched by no group
+type Default struct {
+	// Policy 为allow、deny或者catch-all，默认allow
+	Policy string `yaml:"policy"`
+	// NodePortRange 为catch-all时所有未配置的namespace共用的范围
+	NodePortRange        string `yaml:"nodePortRange"`
+	MaxPortsPerNamespace int    `yaml:"maxPortsPerNamespace"`
+	Strategy             string `yaml:"strategy"`
+}
+
+// Items maps the name of a group of namespaces to its definition
+type Items map[string]Group
+
+// Group is a set of namespaces, when NodePortRange is set it is a shared pool whose
+// ports any namespace of the group without its own sub-range can draw from
+type Group struct {
+	NodePortRange string `yaml:"nodePortRange"`
+	// MaxPortsPerNamespace 为组内每个namespace默认的端口配额
+	MaxPortsPerNamespace int `yaml:"maxPortsPerNamespace"`
+	// Reserved 中的端口不会分配给组内的namespace
+	Reserved string `yaml:"reserved"`
+	// Strategy 为组内namespace默认的端口分配策略
+	Strategy   string `yaml:"strategy"`
+	Namespaces []Item `yaml:"namespaces"`
+}
 
 type Item struct {
-	Namespace     string `yaml:"namespace"`
+	// Namespace 可以是namespace名称，也可以是team-a-*这样的glob
+	Namespace string `yaml:"namespace"`
+	// NamespaceSelector 按namespace的label匹配，例如team=a,env in (dev,prod)，与Namespace同时设置时都需要匹配
+	NamespaceSelector string `yaml:"namespaceSelector"`
+	// NodePortRange 可选，设置了组范围时必须在组范围之内
 	NodePortRange string `yaml:"nodePortRange"`
+	// MaxPorts 为namespace最多可使用的端口数量，MinPorts 为保证可用的端口数量
+	MaxPorts int `yaml:"maxPorts"`
+	MinPorts int `yaml:"minPorts"`
+	// Reserved 中的端口不会分配给该namespace
+	Reserved string `yaml:"reserved"`
+	// Strategy 为空时使用组的分配策略
+	Strategy string `yaml:"strategy"`
+}
+
+// UnmarshalYAML accepts both a plain list of namespaces and the group form with a shared range
+func (g *Group) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.SequenceNode {
+		return node.Decode(&g.Namespaces)
+	}
+
+	type plain Group
+	return node.Decode((*plain)(g))
+}
+
+// PortRange is one segment of a nodePortRange, a single port has Start == End
+type PortRange struct {
+	Start int32
+	End   int32
 }
 
 type Result struct {
 	Namespace string
-	PortStart int32
-	PortEnd   int32
+	// Group 为namespace所在组的名称
+	Group  string
+	Ranges []PortRange
+	// Shared 为true时Ranges是组的共享范围，由组内所有没有子范围的namespace共用
+	Shared bool
+	// 端口配额，0表示不限制
+	MaxPorts int
+	MinPorts int
+	// Reserved 为namespace及其所在组的保留端口
+	Reserved []PortRange
+	// Strategy 为端口分配策略，空表示默认策略
+	Strategy string
+	// Pool 为共享端口池的名称，独占范围的namespace为空
+	Pool string
+	// Selector 为namespace的label selector，与glob的Namespace一样匹配多个namespace
+	Selector string
+}
+
+// Dynamic reports whether the result matches namespaces by glob or label selector. Its
+// ports form a shared pool of every matching namespace, bound when a namespace is first seen.
+func (r Result) Dynamic() bool {
+	return IsPattern(r.Namespace) || r.Selector != ""
+}
+
+// IsPattern reports whether namespace is a glob rather than a name
+func IsPattern(namespace string) bool {
+	return strings.ContainsAny(namespace, "*?[")
 }
 
 type Results []Result
 
-func LoadConfigFromFile(configFile string) Results {
+// Config is the parsed configuration of all namespaces
+type Config struct {
+	Namespaces Results
+	// Reserved ports are never handed out to any namespace
+	Reserved []PortRange
+	Default  Default
+	// DefaultRanges is the parsed catch-all range of Default
+	DefaultRanges []PortRange
+}
+
+// SetDefault sets the default policy, the catch-all range must not overlap any group
+func (c *Config) SetDefault(d Default) error {
+	var ranges []PortRange
+	if d.NodePortRange != "" {
+		var err error
+		if ranges, err = ParsePortRange(d.NodePortRange); err != nil {
+			return fmt.Errorf("error parse default nodeportrange %s: %v", d.NodePortRange, err)
+		}
+		catchAll := Result{Namespace: "*", Group: "default", Ranges: ranges}
+		append(append(Results(nil), c.Namespaces...), catchAll).checkOverlap()
+	}
+
+	c.Default = d
+	c.DefaultRanges = ranges
+	return nil
+}
+
+func LoadConfigFromFile(configFile string) *Config {
 	y, err := os.ReadFile(configFile)
 	if err != nil {
 		klog.Fatalln("error read file", err)
 	}
 
-	var items Items
-	err = yaml.Unmarshal(y, &items)
+	var root yaml.Node
+	if err := yaml.Unmarshal(y, &root); err != nil {
+		klog.Fatalln(err)
+	}
+
+	// 顶层有groups时为新格式，否则整个文件都是组的定义
+	var file File
+	if hasKey(&root, "groups") {
+		err = root.Decode(&file)
+	} else {
+		err = root.Decode(&file.Groups)
+	}
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	reserved, err := ParsePortList(file.Reserved)
 	if err != nil {
+		klog.Fatalln("error parse reserved ports", err)
+	}
+
+	config := &Config{
+		Namespaces: LoadConfigFromItems(file.Groups),
+		Reserved:   reserved,
+	}
+	if err := config.SetDefault(file.Default); err != nil {
 		klog.Fatalln(err)
 	}
+	return config
+}
+
+// hasKey reports whether the top level mapping of a document contains key
+func hasKey(root *yaml.Node, key string) bool {
+	node := root
+	if node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	if node.Kind != yaml.MappingNode {
+		return false
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePortList parses an optional list in the nodePortRange format, an empty list is allowed
+func ParsePortList(list string) ([]PortRange, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+	return ParsePortRange(list)
+}
+
+// LoadConfigFromItems parses the ranges of items, which may come from the config file or
+// from NodePortPool resources
+func LoadConfigFromItems(items Items) Results {
+	var results Results
+	for group, v := range items {
+		results = append(results, loadGroup(group, v)...)
+	}
+
+	// check if nodePort overlap, if so, exit
+	results.checkOverlap()
 
+	return results
+}
+
+func loadGroup(group string, g Group) Results {
 	var results Results
-	for _, v := range items {
-		for _, vv := range v {
-			start, end, err := ParsePortRange(vv.NodePortRange)
+
+	var groupRanges []PortRange
+	if g.NodePortRange != "" {
+		var err error
+		groupRanges, err = ParsePortRange(g.NodePortRange)
+		if err != nil {
+			klog.Warningf("error parse nodeportrange of group %s, got %s, skip this", group, g.NodePortRange)
+			return nil
+		}
+	}
+
+	groupReserved, err := ParsePortList(g.Reserved)
+	if err != nil {
+		klog.Warningf("error parse reserved ports of group %s, got %s, skip this", group, g.Reserved)
+		return nil
+	}
+
+	var shared []Item
+	var subRanges []PortRange
+	for _, vv := range g.Namespaces {
+		if err := vv.validate(); err != nil {
+			klog.Warningf("invalid namespace entry %s of group %s, skip this: %v", vv.name(), group, err)
+			continue
+		}
+		if vv.NodePortRange == "" {
+			if groupRanges == nil {
+				klog.Warningf("namespace %s of group %s has no nodeportrange and the group has no shared range, skip this", vv.name(), group)
+				continue
+			}
+			shared = append(shared, vv)
+			continue
+		}
+
+		ranges, err := ParsePortRange(vv.NodePortRange)
+		if err != nil {
+			klog.Warningf("error parse nodeportrange of %s, got %s, skip this", vv.Namespace, vv.NodePortRange)
+			continue
+		}
+		reserved, err := ParsePortList(vv.Reserved)
+		if err != nil {
+			klog.Warningf("error parse reserved ports of %s, got %s, skip this", vv.Namespace, vv.Reserved)
+			continue
+		}
+		if groupRanges != nil && !within(ranges, groupRanges) {
+			klog.Warningf("nodeportrange %s of %s is not inside the range %s of group %s, skip this", vv.NodePortRange, vv.Namespace, g.NodePortRange, group)
+			continue
+		}
+		subRanges = append(subRanges, ranges...)
+		result := Result{
+			Namespace: vv.Namespace,
+			Group:     group,
+			Ranges:    ranges,
+			MaxPorts:  g.maxPorts(vv),
+			MinPorts:  vv.MinPorts,
+			Reserved:  append(reserved, groupReserved...),
+			Strategy:  g.strategy(vv),
+			Selector:  vv.NamespaceSelector,
+		}
+		// glob或者selector匹配的namespace共用自己的范围
+		if result.Dynamic() {
+			result.Shared = true
+			result.Pool = group + "/" + vv.name()
+		}
+		results = append(results, result)
+	}
+
+	// 组内没有子范围的namespace共用去掉子范围之后剩余的端口
+	if len(shared) > 0 {
+		remainder := subtract(groupRanges, subRanges)
+		if len(remainder) == 0 {
+			klog.Warningf("sub-ranges use up the range %s of group %s, namespaces without a sub-range get no ports", g.NodePortRange, group)
+			return results
+		}
+		guaranteed := 0
+		for _, vv := range shared {
+			reserved, err := ParsePortList(vv.Reserved)
 			if err != nil {
-				klog.Warningf("error parse nodeportrange of %s, got %s, skip this", vv.Namespace, vv.NodePortRange)
+				klog.Warningf("error parse reserved ports of %s, got %s, skip this", vv.Namespace, vv.Reserved)
 				continue
 			}
-			result := Result{
+			guaranteed += vv.MinPorts
+			results = append(results, Result{
 				Namespace: vv.Namespace,
-				PortStart: start,
-				PortEnd:   end,
-			}
-			results = append(results, result)
+				Group:     group,
+				Ranges:    remainder,
+				Shared:    true,
+				MaxPorts:  g.maxPorts(vv),
+				MinPorts:  vv.MinPorts,
+				Reserved:  append(reserved, groupReserved...),
+				Strategy:  g.strategy(vv),
+				Pool:      group,
+				Selector:  vv.NamespaceSelector,
+			})
+		}
+		if size := rangesSize(remainder); guaranteed > size {
+			klog.Warningf("group %s guarantees %d nodePorts but its shared range only has %d", group, guaranteed, size)
 		}
 	}
 
-	// check if nodePort overlap, if so, exit
-	results.checkOverlap()
-
 	return results
 }
 
-func ParsePortRange(portRange string) (int32, int32, error) {
-	ports := strings.Split(portRange, "-")
-	min, err := strconv.ParseInt(ports[0], 10, 32)
-	if err != nil {
-		klog.Warning(err)
-		return -1, -1, err
+// ParsePortRange parses a comma separated list of segments such as
+// "30000-30050,30200-30220,30999"
+func ParsePortRange(portRange string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, segment := range strings.Split(portRange, ",") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		r, err := parseSegment(segment)
+		if err != nil {
+			klog.Warning(err)
+			return nil, err
+		}
+		ranges = append(ranges, r)
+	}
+
+	if len(ranges) == 0 {
+		return nil, fmt.Errorf("nodeport range %q is empty", portRange)
 	}
-	max, err := strconv.ParseInt(ports[1], 10, 32)
+
+	return ranges, nil
+}
+
+func parseSegment(segment string) (PortRange, error) {
+	ports := strings.SplitN(segment, "-", 2)
+	min, err := strconv.ParseInt(strings.TrimSpace(ports[0]), 10, 32)
 	if err != nil {
-		klog.Warning(err)
-		return -1, -1, err
+		return PortRange{}, err
+	}
+	max := min
+	if len(ports) == 2 {
+		max, err = strconv.ParseInt(strings.TrimSpace(ports[1]), 10, 32)
+		if err != nil {
+			return PortRange{}, err
+		}
+	}
+
+	if min > max || min < NodePortMinPort || max > NodePortMaxPort {
+		return PortRange{}, fmt.Errorf("nodeport range %s MUST from small to big,and MUST between 30000 to 32767", segment)
+	}
+
+	return PortRange{Start: int32(min), End: int32(max)}, nil
+}
+
+func (r PortRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(int(r.Start))
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+func (r PortRange) overlaps(o PortRange) bool {
+	return r.Start <= o.End && o.Start <= r.End
+}
+
+// maxPorts returns the quota of a namespace, falling back to the default of the group
+func (g Group) maxPorts(item Item) int {
+	if item.MaxPorts > 0 {
+		return item.MaxPorts
+	}
+	return g.MaxPortsPerNamespace
+}
+
+// name describes the entry in logs and names the pool of a glob or selector entry
+func (i Item) name() string {
+	if i.NamespaceSelector == "" {
+		return i.Namespace
+	}
+	if i.Namespace == "" {
+		return "{" + i.NamespaceSelector + "}"
 	}
+	return i.Namespace + "{" + i.NamespaceSelector + "}"
+}
 
-	if min > max || min >= NodePortMinPort || max <= NodePortMaxPort {
-		msg := fmt.Errorf("nodeport range MUST from small to big,and MUST between 30000 to 32767")
-		klog.Warning(msg)
-		return -1, -1, msg
+func (i Item) validate() error {
+	if i.Namespace == "" && i.NamespaceSelector == "" {
+		return fmt.Errorf("either namespace or namespaceSelector MUST be set")
+	}
+	if IsPattern(i.Namespace) {
+		if _, err := path.Match(i.Namespace, ""); err != nil {
+			return fmt.Errorf("bad namespace pattern %s: %v", i.Namespace, err)
+		}
+	}
+	if i.NamespaceSelector != "" {
+		if _, err := labels.Parse(i.NamespaceSelector); err != nil {
+			return fmt.Errorf("bad namespaceSelector %s: %v", i.NamespaceSelector, err)
+		}
+	}
+	return nil
+}
+
+func (g Group) strategy(item Item) string {
+	if item.Strategy != "" {
+		return item.Strategy
+	}
+	return g.Strategy
+}
+
+func rangesSize(ranges []PortRange) int {
+	size := 0
+	for _, r := range ranges {
+		size += int(r.End-r.Start) + 1
+	}
+	return size
+}
+
+// within reports whether every segment of ranges lies inside one of outer
+func within(ranges, outer []PortRange) bool {
+	for _, r := range ranges {
+		inside := false
+		for _, o := range outer {
+			if r.Start >= o.Start && r.End <= o.End {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			return false
+		}
 	}
+	return true
+}
 
-	return int32(min), int32(max), nil
+// subtract returns the segments of ranges that are not covered by holes
+func subtract(ranges, holes []PortRange) []PortRange {
+	sorted := append([]PortRange(nil), holes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+
+	var remainder []PortRange
+	for _, r := range ranges {
+		start := r.Start
+		for _, h := range sorted {
+			if h.End < start || h.Start > r.End {
+				continue
+			}
+			if h.Start > start {
+				remainder = append(remainder, PortRange{Start: start, End: h.Start - 1})
+			}
+			start = h.End + 1
+		}
+		if start <= r.End {
+			remainder = append(remainder, PortRange{Start: start, End: r.End})
+		}
+	}
+	return remainder
 }
 
 func (r Results) checkOverlap() {
-	for i := 0; i < len(r); i++ {
-		for j := 0; j < len(r); j++ {
-			if i != j {
-				if (r[i].PortStart >= r[j].PortStart && r[i].PortStart <= r[j].PortEnd) ||
-					(r[i].PortEnd >= r[j].PortStart && r[i].PortStart <= r[j].PortEnd) {
-					klog.Infof("nodeport range of namespace %s/(%d-%d) overlaps with port range of namespace %s/(%d-%d),exit the program.\n",
-						r[i].Namespace, r[i].PortStart, r[i].PortEnd,
-						r[j].Namespace, r[j].PortStart, r[j].PortEnd)
-					os.Exit(1)
-				}
+	type segment struct {
+		namespace string
+		group     string
+		// 共享范围在同一个端口池的namespace之间不算重叠
+		sharedGroup string
+		PortRange
+	}
+	var segments []segment
+	for _, result := range r {
+		sharedGroup := ""
+		if result.Shared {
+			sharedGroup = result.Pool
+		}
+		for _, pr := range result.Ranges {
+			segments = append(segments, segment{namespace: result.Namespace, group: result.Group, sharedGroup: sharedGroup, PortRange: pr})
+		}
+	}
+
+	for i := 0; i < len(segments); i++ {
+		for j := i + 1; j < len(segments); j++ {
+			if segments[i].sharedGroup != "" && segments[i].sharedGroup == segments[j].sharedGroup {
+				continue
+			}
+			if segments[i].overlaps(segments[j].PortRange) {
+				klog.Infof("nodeport range of namespace %s/(%s) in group %s overlaps with port range of namespace %s/(%s) in group %s,exit the program.\n",
+					segments[i].namespace, segments[i].PortRange, segments[i].group,
+					segments[j].namespace, segments[j].PortRange, segments[j].group)
+				os.Exit(1)
 			}
 		}
 	}
@@ -0,0 +1,151 @@
+package crd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/tiggoins/port-allocator/store"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+// claimSyncPeriod is how often the NodePortClaims are brought in line with the store
+const claimSyncPeriod = 10 * time.Second
+
+// ClaimSyncer publishes every allocation of the store as a NodePortClaim
+type ClaimSyncer struct {
+	client dynamic.Interface
+	s      *store.NamespaceNodePortConfig
+}
+
+func NewClaimSyncer(client dynamic.Interface, s *store.NamespaceNodePortConfig) *ClaimSyncer {
+	return &ClaimSyncer{client: client, s: s}
+}
+
+// Run syncs the claims until ctx is done, it is meant to run on the leader only
+func (cs *ClaimSyncer) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := cs.sync(ctx); err != nil {
+			klog.Errorf("failed to sync nodeportclaims: %v", err)
+		}
+	}, claimSyncPeriod)
+}
+
+func (cs *ClaimSyncer) sync(ctx context.Context) error {
+	desired := make(map[types.NamespacedName]*NodePortClaim)
+	for _, alloc := range cs.s.Snapshot() {
+		claim := claimFor(alloc)
+		desired[types.NamespacedName{Namespace: claim.Namespace, Name: claim.Name}] = claim
+	}
+
+	claims := cs.client.Resource(NodePortClaimResource)
+	existing, err := claims.Namespace(metav1.NamespaceAll).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{ManagedByLabel: managedBy}.String(),
+	})
+	if err != nil {
+		return fmt.Errorf("list nodeportclaims: %v", err)
+	}
+
+	for i := range existing.Items {
+		obj := &existing.Items[i]
+		key := types.NamespacedName{Namespace: obj.GetNamespace(), Name: obj.GetName()}
+		want, ok := desired[key]
+		if !ok {
+			if err := claims.Namespace(key.Namespace).Delete(ctx, key.Name, metav1.DeleteOptions{}); err != nil && !apierrors.IsNotFound(err) {
+				klog.Warningf("cannot delete nodeportclaim %s: %v", key, err)
+			}
+			continue
+		}
+		delete(desired, key)
+
+		var have NodePortClaim
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &have); err != nil {
+			klog.Warningf("cannot decode nodeportclaim %s: %v", key, err)
+			continue
+		}
+		if equality.Semantic.DeepEqual(have.Spec, want.Spec) &&
+			equality.Semantic.DeepEqual(have.Status, want.Status) &&
+			equality.Semantic.DeepEqual(have.OwnerReferences, want.OwnerReferences) {
+			continue
+		}
+		want.ResourceVersion = have.ResourceVersion
+		if err := cs.write(ctx, want, true); err != nil {
+			klog.Warningf("cannot update nodeportclaim %s: %v", key, err)
+		}
+	}
+
+	for key, want := range desired {
+		if err := cs.write(ctx, want, false); err != nil && !apierrors.IsAlreadyExists(err) {
+			klog.Warningf("cannot create nodeportclaim %s: %v", key, err)
+		}
+	}
+
+	return nil
+}
+
+func (cs *ClaimSyncer) write(ctx context.Context, claim *NodePortClaim, update bool) error {
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(claim)
+	if err != nil {
+		return err
+	}
+	obj := &unstructured.Unstructured{Object: content}
+	claims := cs.client.Resource(NodePortClaimResource).Namespace(claim.Namespace)
+	if update {
+		_, err = claims.Update(ctx, obj, metav1.UpdateOptions{})
+	} else {
+		_, err = claims.Create(ctx, obj, metav1.CreateOptions{})
+	}
+	return err
+}
+
+// claimFor builds the NodePortClaim of an allocation, named after the Service and port
+func claimFor(alloc store.Allocation) *NodePortClaim {
+	serviceName := strings.TrimPrefix(alloc.Owner, alloc.Namespace+"/")
+	phase := ClaimBound
+	if alloc.Reserved() {
+		phase = ClaimReserved
+	}
+	kind := alloc.Kind
+	if kind == "" {
+		kind = store.PortInRange
+	}
+
+	claim := &NodePortClaim{
+		TypeMeta: metav1.TypeMeta{APIVersion: Group + "/" + Version, Kind: "NodePortClaim"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%d", serviceName, alloc.Port),
+			Namespace: alloc.Namespace,
+			Labels:    map[string]string{ManagedByLabel: managedBy},
+		},
+		Spec: NodePortClaimSpec{
+			ServiceRef: ServiceReference{Name: serviceName, UID: alloc.UID},
+			NodePort:   alloc.Port,
+		},
+		Status: NodePortClaimStatus{
+			Phase: phase,
+			// 序列化后只保留到秒，截断以免每次同步都被判定为变化
+			AllocatedAt: metav1.NewTime(alloc.AllocatedAt.Truncate(time.Second)),
+			Kind:        string(kind),
+		},
+	}
+	if alloc.UID != "" {
+		claim.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "v1",
+			Kind:       "Service",
+			Name:       serviceName,
+			UID:        types.UID(alloc.UID),
+		}}
+	}
+
+	return claim
+}
@@ -0,0 +1,49 @@
+package crd
+
+import (
+	"context"
+
+	"github.com/tiggoins/port-allocator/config"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/klog/v2"
+)
+
+// LoadConfigFromPools reads every NodePortPool and parses it the same way as port-range.yaml
+func LoadConfigFromPools(client dynamic.Interface) *config.Config {
+	list, err := client.Resource(NodePortPoolResource).List(context.TODO(), metav1.ListOptions{})
+	if err != nil {
+		klog.Fatalln("error list nodeportpools", err)
+	}
+
+	items := make(config.Items)
+	for i := range list.Items {
+		var pool NodePortPool
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(list.Items[i].Object, &pool); err != nil {
+			klog.Warningf("error decode nodeportpool %s, skip this: %v", list.Items[i].GetName(), err)
+			continue
+		}
+		group := config.Group{
+			NodePortRange:        pool.Spec.NodePortRange,
+			MaxPortsPerNamespace: pool.Spec.MaxPortsPerNamespace,
+			Reserved:             pool.Spec.Reserved,
+			Strategy:             pool.Spec.Strategy,
+		}
+		for _, ns := range pool.Spec.Namespaces {
+			group.Namespaces = append(group.Namespaces, config.Item{
+				Namespace:         ns.Namespace,
+				NamespaceSelector: ns.NamespaceSelector,
+				NodePortRange:     ns.NodePortRange,
+				MaxPorts:          ns.MaxPorts,
+				MinPorts:          ns.MinPorts,
+				Reserved:          ns.Reserved,
+				Strategy:          ns.Strategy,
+			})
+		}
+		items[pool.Name] = group
+	}
+
+	// 全局保留端口只能通过--reserved-ports指定
+	return &config.Config{Namespaces: config.LoadConfigFromItems(items)}
+}
@@ -0,0 +1,97 @@
+package crd
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	Group   = "portallocator.tiggoins.github.io"
+	Version = "v1alpha1"
+
+	// ManagedByLabel marks the NodePortClaims written by the allocator
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	managedBy      = "port-allocator"
+)
+
+var (
+	NodePortPoolResource  = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "nodeportpools"}
+	NodePortClaimResource = schema.GroupVersionResource{Group: Group, Version: Version, Resource: "nodeportclaims"}
+)
+
+// NodePortPool is a cluster-scoped group of namespaces and their nodePort ranges,
+// it takes the place of one top level entry of port-range.yaml
+type NodePortPool struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec NodePortPoolSpec `json:"spec"`
+}
+
+type NodePortPoolSpec struct {
+	// NodePortRange is shared by the namespaces of the pool that have no range of their own
+	NodePortRange string          `json:"nodePortRange,omitempty"`
+	Namespaces    []PoolNamespace `json:"namespaces"`
+	// MaxPortsPerNamespace is the default quota of the namespaces of the pool
+	MaxPortsPerNamespace int `json:"maxPortsPerNamespace,omitempty"`
+	// Strategy used to pick ports for the namespaces of the pool, one of first-fit, random,
+	// least-recently-released or round-robin (default)
+	Strategy string `json:"strategy,omitempty"`
+	// Reserved ports are never handed out to the namespaces of the pool
+	Reserved string `json:"reserved,omitempty"`
+}
+
+type PoolNamespace struct {
+	// Namespace is a name or a glob such as team-a-*
+	Namespace string `json:"namespace,omitempty"`
+	// NamespaceSelector matches namespaces by label, e.g. "team=a". Namespaces matched by glob
+	// or selector share the range of the entry.
+	NamespaceSelector string `json:"namespaceSelector,omitempty"`
+	// NodePortRange uses the format of port-range.yaml, e.g. "30000-30050,30999". It is
+	// optional when the pool has a shared range and must then lie inside of it.
+	NodePortRange string `json:"nodePortRange,omitempty"`
+	// MaxPorts limits and MinPorts guarantees the ports of the namespace
+	MaxPorts int `json:"maxPorts,omitempty"`
+	MinPorts int `json:"minPorts,omitempty"`
+	// Reserved ports are never handed out to the namespace
+	Reserved string `json:"reserved,omitempty"`
+	// Strategy overrides the strategy of the pool for the namespace
+	Strategy string `json:"strategy,omitempty"`
+}
+
+// NodePortClaim mirrors one allocation of the store, it lives in the namespace of the
+// Service holding the port
+type NodePortClaim struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   NodePortClaimSpec   `json:"spec"`
+	Status NodePortClaimStatus `json:"status,omitempty"`
+}
+
+type NodePortClaimSpec struct {
+	ServiceRef ServiceReference `json:"serviceRef"`
+	NodePort   int32            `json:"nodePort"`
+}
+
+type ServiceReference struct {
+	Name string `json:"name"`
+	UID  string `json:"uid,omitempty"`
+}
+
+type ClaimPhase string
+
+const (
+	// ClaimReserved means the webhook handed out the port and waits for the Service
+	ClaimReserved ClaimPhase = "Reserved"
+	// ClaimBound means the Service holding the port was observed
+	ClaimBound ClaimPhase = "Bound"
+)
+
+type NodePortClaimStatus struct {
+	Phase       ClaimPhase  `json:"phase,omitempty"`
+	AllocatedAt metav1.Time `json:"allocatedAt,omitempty"`
+	// Kind is in-range, foreign when the port lies in the range of another namespace or
+	// unmanaged when it lies in no range
+	Kind string `json:"kind,omitempty"`
+}
@@ -18,10 +18,15 @@ import (
 	"github.com/tiggoins/port-allocator/k8s"
 )
 
-func Election(client *kubernetes.Clientset) {
+// Election runs leader election, leaderFuncs are started when this replica becomes the
+// leader and their context is cancelled once it stops leading
+func Election(client *kubernetes.Clientset, leaderFuncs ...func(ctx context.Context)) {
 	callbacks := leaderelection.LeaderCallbacks{
 		OnStartedLeading: func(ctx context.Context) {
 			klog.V(2).InfoS("I am the new leader now.")
+			for _, f := range leaderFuncs {
+				go f(ctx)
+			}
 		},
 		OnStoppedLeading: func() {
 			klog.V(2).InfoS("I am not the leader anymore.")
@@ -1,13 +1,14 @@
 package k8s
 
 import (
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 	"k8s.io/klog/v2"
 )
 
-func BuildKubernetesClient() *kubernetes.Clientset {
+func buildRestConfig() *rest.Config {
 	var restConf *rest.Config
 
 	restConf, err := clientcmd.BuildConfigFromFlags("", "")
@@ -18,8 +19,17 @@ func BuildKubernetesClient() *kubernetes.Clientset {
 			klog.Fatalln("still cannot build rest config", err)
 		}
 	}
-	
-	kubeClient := kubernetes.NewForConfigOrDie(restConf)
+
+	return restConf
+}
+
+func BuildKubernetesClient() *kubernetes.Clientset {
+	kubeClient := kubernetes.NewForConfigOrDie(buildRestConfig())
 
 	return kubeClient
 }
+
+// BuildDynamicClient returns a client for the NodePortPool and NodePortClaim custom resources
+func BuildDynamicClient() dynamic.Interface {
+	return dynamic.NewForConfigOrDie(buildRestConfig())
+}
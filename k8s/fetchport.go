@@ -4,19 +4,23 @@ import (
 	"context"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 )
 
 type NamespacePort struct {
 	Namespace string
+	// Service 为占用端口的service名称
+	Service   string
+	UID       string
 	NodePorts []int32
+	// Protocols 为每个nodePort使用的协议
+	Protocols map[int32][]string
 }
 
 func ListNamespaces(kubeClient *kubernetes.Clientset) []string {
 	var namespaces []string
-	
+
 	ns, err := kubeClient.CoreV1().Namespaces().List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		klog.Fatalln("error happened when list namespaces from cluster.")
@@ -29,27 +33,29 @@ func ListNamespaces(kubeClient *kubernetes.Clientset) []string {
 	return namespaces
 }
 
-func GetNamespacedAllocatedNodePort(kubeClient *kubernetes.Clientset, namespace string) NamespacePort {
-	var np NamespacePort
-
-	nodePortSelector := labels.Set{"type": "NodePort"}.AsSelector()
+func GetNamespacedAllocatedNodePort(kubeClient *kubernetes.Clientset, namespace string) []NamespacePort {
+	var nps []NamespacePort
 
-	services, err := kubeClient.CoreV1().Services(metav1.NamespaceAll).List(context.TODO(), metav1.ListOptions{
-		LabelSelector: nodePortSelector.String(),
-	})
+	services, err := kubeClient.CoreV1().Services(namespace).List(context.TODO(), metav1.ListOptions{})
 	if err != nil {
 		klog.Fatalln("error list service in the cluster", err)
 	}
 
 	// 遍历服务列表
 	for _, service := range services.Items {
-		// 获取命名空间对应的端口列表，并追加到 s 中
-		var ports []int32
-		for _, port := range service.Spec.Ports {
-			ports = append(ports, port.NodePort)
+		// 获取service对应的端口列表，包括LoadBalancer和healthCheckNodePort
+		ports := ServiceNodePorts(&service)
+		if len(ports) == 0 {
+			continue
 		}
-		np = NamespacePort{Namespace: service.Namespace, NodePorts: ports}
+		nps = append(nps, NamespacePort{
+			Namespace: service.Namespace,
+			Service:   service.Name,
+			UID:       string(service.UID),
+			NodePorts: ports,
+			Protocols: NodePortProtocols(&service),
+		})
 	}
 
-	return np
+	return nps
 }
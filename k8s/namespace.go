@@ -0,0 +1,28 @@
+package k8s
+
+import (
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// NamespaceLabels starts an informer on namespaces and returns a lookup of their labels
+// from its cache, it blocks until the cache synced
+func NamespaceLabels(kubeClient kubernetes.Interface, stopCh <-chan struct{}) func(string) (map[string]string, bool) {
+	factory := informers.NewSharedInformerFactory(kubeClient, 0)
+	lister := factory.Core().V1().Namespaces().Lister()
+	factory.Start(stopCh)
+	for informer, synced := range factory.WaitForCacheSync(stopCh) {
+		if !synced {
+			klog.Warningf("cache of %v did not sync, namespace selectors may not match", informer)
+		}
+	}
+
+	return func(name string) (map[string]string, bool) {
+		ns, err := lister.Get(name)
+		if err != nil {
+			return nil, false
+		}
+		return ns.Labels, true
+	}
+}
@@ -0,0 +1,118 @@
+package k8s
+
+import (
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ConsumesNodePorts reports whether service is of a type that can hold nodePorts
+func ConsumesNodePorts(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeNodePort || service.Spec.Type == corev1.ServiceTypeLoadBalancer
+}
+
+// AllocatesNodePorts reports whether every ServicePort of service should get a nodePort,
+// LoadBalancer services may opt out with allocateLoadBalancerNodePorts: false
+func AllocatesNodePorts(service *corev1.Service) bool {
+	switch service.Spec.Type {
+	case corev1.ServiceTypeNodePort:
+		return true
+	case corev1.ServiceTypeLoadBalancer:
+		return service.Spec.AllocateLoadBalancerNodePorts == nil || *service.Spec.AllocateLoadBalancerNodePorts
+	}
+	return false
+}
+
+// NeedsHealthCheckNodePort reports whether service gets a healthCheckNodePort
+func NeedsHealthCheckNodePort(service *corev1.Service) bool {
+	return service.Spec.Type == corev1.ServiceTypeLoadBalancer &&
+		service.Spec.ExternalTrafficPolicy == corev1.ServiceExternalTrafficPolicyLocal
+}
+
+// ServiceNodePorts returns every nodePort held by service, including the healthCheckNodePort.
+// A nodePort shared by a TCP/UDP pair is returned once.
+func ServiceNodePorts(service *corev1.Service) []int32 {
+	var ports []int32
+	for port := range NodePortProtocols(service) {
+		ports = append(ports, port)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i] < ports[j]
+	})
+
+	return ports
+}
+
+// RemovedNodePorts returns the nodePorts of oldService that service no longer uses, every
+// nodePort of oldService when service does not consume nodePorts
+func RemovedNodePorts(oldService, service *corev1.Service) []int32 {
+	kept := make(map[int32]bool)
+	for _, port := range ServiceNodePorts(service) {
+		kept[port] = true
+	}
+
+	var removed []int32
+	for _, port := range ServiceNodePorts(oldService) {
+		if !kept[port] {
+			removed = append(removed, port)
+		}
+	}
+	return removed
+}
+
+// AddedNodePorts returns the nodePorts of service that oldService did not use
+func AddedNodePorts(oldService, service *corev1.Service) []int32 {
+	return RemovedNodePorts(service, oldService)
+}
+
+// NodePortProtocols maps every nodePort held by service to the protocols using it, the
+// healthCheckNodePort is served over TCP
+func NodePortProtocols(service *corev1.Service) map[int32][]string {
+	protocols := make(map[int32][]string)
+	if !ConsumesNodePorts(service) {
+		return protocols
+	}
+
+	for _, port := range service.Spec.Ports {
+		if port.NodePort != 0 {
+			protocols[port.NodePort] = append(protocols[port.NodePort], Protocol(port))
+		}
+	}
+	if NeedsHealthCheckNodePort(service) && service.Spec.HealthCheckNodePort != 0 {
+		port := service.Spec.HealthCheckNodePort
+		protocols[port] = append(protocols[port], string(corev1.ProtocolTCP))
+	}
+
+	return protocols
+}
+
+// Protocol returns the protocol of a ServicePort, TCP when it was not defaulted yet
+func Protocol(port corev1.ServicePort) string {
+	if port.Protocol == "" {
+		return string(corev1.ProtocolTCP)
+	}
+	return string(port.Protocol)
+}
+
+// HealthCheckPortName is the name NamedNodePorts gives the healthCheckNodePort, ServicePort
+// names are DNS labels so it never clashes with them
+const HealthCheckPortName = "healthCheckNodePort"
+
+// NamedNodePorts maps the name of every ServicePort holding a nodePort to the nodePort
+func NamedNodePorts(service *corev1.Service) map[string]int32 {
+	named := make(map[string]int32)
+	if !ConsumesNodePorts(service) {
+		return named
+	}
+
+	for _, port := range service.Spec.Ports {
+		if port.NodePort != 0 {
+			named[port.Name] = port.NodePort
+		}
+	}
+	if NeedsHealthCheckNodePort(service) && service.Spec.HealthCheckNodePort != 0 {
+		named[HealthCheckPortName] = service.Spec.HealthCheckNodePort
+	}
+
+	return named
+}
@@ -0,0 +1,130 @@
+package k8s
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+type webhookConfigClient[C any] interface {
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (C, error)
+	Create(ctx context.Context, config C, opts metav1.CreateOptions) (C, error)
+	Update(ctx context.Context, config C, opts metav1.UpdateOptions) (C, error)
+}
+
+// WebhookConfigs gets, compares and updates the Mutating or ValidatingWebhookConfigurations,
+// C is the configuration and W the type of its webhooks
+type WebhookConfigs[C any, W any] struct {
+	kind         string
+	client       webhookConfigClient[C]
+	newConfig    func(name string, webhooks []W) C
+	webhooks     func(config C) []W
+	setWebhooks  func(config C, webhooks []W)
+	clientConfig func(webhook *W) *admissionregistrationv1.WebhookClientConfig
+	deepCopy     func(config C) C
+}
+
+func MutatingWebhookConfigs(client kubernetes.Interface) *WebhookConfigs[*admissionregistrationv1.MutatingWebhookConfiguration, admissionregistrationv1.MutatingWebhook] {
+	type config = admissionregistrationv1.MutatingWebhookConfiguration
+	type webhook = admissionregistrationv1.MutatingWebhook
+	return &WebhookConfigs[*config, webhook]{
+		kind:   "MutatingWebhookConfiguration",
+		client: client.AdmissionregistrationV1().MutatingWebhookConfigurations(),
+		newConfig: func(name string, webhooks []webhook) *config {
+			return &config{ObjectMeta: metav1.ObjectMeta{Name: name}, Webhooks: webhooks}
+		},
+		webhooks:     func(c *config) []webhook { return c.Webhooks },
+		setWebhooks:  func(c *config, webhooks []webhook) { c.Webhooks = webhooks },
+		clientConfig: func(w *webhook) *admissionregistrationv1.WebhookClientConfig { return &w.ClientConfig },
+		deepCopy:     (*config).DeepCopy,
+	}
+}
+
+func ValidatingWebhookConfigs(client kubernetes.Interface) *WebhookConfigs[*admissionregistrationv1.ValidatingWebhookConfiguration, admissionregistrationv1.ValidatingWebhook] {
+	type config = admissionregistrationv1.ValidatingWebhookConfiguration
+	type webhook = admissionregistrationv1.ValidatingWebhook
+	return &WebhookConfigs[*config, webhook]{
+		kind:   "ValidatingWebhookConfiguration",
+		client: client.AdmissionregistrationV1().ValidatingWebhookConfigurations(),
+		newConfig: func(name string, webhooks []webhook) *config {
+			return &config{ObjectMeta: metav1.ObjectMeta{Name: name}, Webhooks: webhooks}
+		},
+		webhooks:     func(c *config) []webhook { return c.Webhooks },
+		setWebhooks:  func(c *config, webhooks []webhook) { c.Webhooks = webhooks },
+		clientConfig: func(w *webhook) *admissionregistrationv1.WebhookClientConfig { return &w.ClientConfig },
+		deepCopy:     (*config).DeepCopy,
+	}
+}
+
+// Reconcile creates the configuration name or updates it when its webhooks differ from
+// desired. desired is passed the caBundle currently set, nil when the configuration is new.
+func (w *WebhookConfigs[C, W]) Reconcile(ctx context.Context, name string, desired func(caBundle []byte) []W) error {
+	existing, err := w.client.Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if _, err := w.client.Create(ctx, w.newConfig(name, desired(nil)), metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		klog.Infof("created %s %s", w.kind, name)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var caBundle []byte
+	if current := w.webhooks(existing); len(current) > 0 {
+		caBundle = w.clientConfig(&current[0]).CABundle
+	}
+	webhooks := desired(caBundle)
+	if reflect.DeepEqual(w.webhooks(existing), webhooks) {
+		return nil
+	}
+
+	existing = w.deepCopy(existing)
+	w.setWebhooks(existing, webhooks)
+	if _, err := w.client.Update(ctx, existing, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	klog.Infof("reconciled %s %s", w.kind, name)
+	return nil
+}
+
+// InjectCABundle sets caBundle on every webhook of the configuration name, a missing
+// configuration is skipped
+func (w *WebhookConfigs[C, W]) InjectCABundle(ctx context.Context, name string, caBundle []byte) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := w.client.Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			klog.V(2).Infof("%s %s not found, skip injecting caBundle", w.kind, name)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		changed := false
+		webhooks := w.webhooks(config)
+		for i := range webhooks {
+			if clientConfig := w.clientConfig(&webhooks[i]); !bytes.Equal(clientConfig.CABundle, caBundle) {
+				clientConfig.CABundle = caBundle
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+
+		_, err = w.client.Update(ctx, config, metav1.UpdateOptions{})
+		if err == nil {
+			klog.Infof("injected caBundle into %s %s", w.kind, name)
+		}
+		return err
+	})
+}
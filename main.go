@@ -2,16 +2,24 @@ package main
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/klog/v2"
 
 	"github.com/spf13/pflag"
+	"github.com/tiggoins/port-allocator/certs"
 	"github.com/tiggoins/port-allocator/config"
+	"github.com/tiggoins/port-allocator/crd"
 	"github.com/tiggoins/port-allocator/election"
 	"github.com/tiggoins/port-allocator/k8s"
+	"github.com/tiggoins/port-allocator/persist"
 	"github.com/tiggoins/port-allocator/queue"
 	"github.com/tiggoins/port-allocator/store"
 	"github.com/tiggoins/port-allocator/webhook"
@@ -26,47 +34,192 @@ func NewServerFlagSet() *pflag.FlagSet {
 	serverFlags.String("tls-cert-file", "", "Path to the certificate file (MUST specify)")
 	serverFlags.String("tls-key-file", "", "Path to the key file (MUST Specify)")
 	serverFlags.IntP("port", "p", 443, "Port to listen on (default to 443)")
+	serverFlags.Duration("reservation-ttl", store.DefaultReservationTTL, "How long a nodePort handed out by the webhook stays reserved before its Service is observed")
+	serverFlags.Duration("release-cooldown", 0, "How long a released nodePort is skipped by allocation, so that clients still using it do not hit another Service. Survives restarts with --persist-configmap")
+	serverFlags.Duration("sticky-retention", 0, "How long the nodePorts of a deleted Service are handed back first to a Service recreated with the same namespace, name and port name, disabled when 0")
+	serverFlags.String("default-policy", "", "Policy for namespaces without a configured range: allow, deny or catch-all. Overrides the default section of port-range.yaml")
+	serverFlags.String("default-node-port-range", "", "Range shared by namespaces without a configured range when the default policy is catch-all")
+	serverFlags.Int("default-max-ports-per-namespace", 0, "Quota of each namespace drawing from the catch-all range, 0 means unlimited")
+	serverFlags.Bool("cert-bootstrap", false, "Generate the serving certificate, store it in a Secret and inject the caBundle instead of using --tls-cert-file and --tls-key-file")
+	serverFlags.String("cert-secret-name", "port-allocator-certs", "Secret holding the generated certificate when --cert-bootstrap is set")
+	serverFlags.String("service-name", "port-allocator", "Name of the Service fronting the webhook, used for the certificate DNS names")
+	serverFlags.String("webhook-config-name", "port-allocator", "Name of the Mutating and ValidatingWebhookConfiguration of the allocator")
+	serverFlags.Bool("register-webhook", true, "Let the leader create and reconcile the Mutating and ValidatingWebhookConfiguration")
+	serverFlags.String("webhook-failure-policy", "Fail", "failurePolicy of the registered webhook, Fail or Ignore")
+	serverFlags.Int32("webhook-timeout-seconds", 10, "timeoutSeconds of the registered webhook")
+	serverFlags.Int32("service-port", 443, "Port of the Service fronting the webhook")
+	serverFlags.String("tls-ca-file", "", "Path to the CA that signed --tls-cert-file, injected into the registered webhook")
+	serverFlags.String("config-source", "file", "Where namespace ranges are read from, file for port-range.yaml or crd for NodePortPool resources")
+	serverFlags.Bool("sync-claims", false, "Let the leader publish every allocation as a NodePortClaim")
+	serverFlags.String("persist-configmap", "", "ConfigMap in the allocator namespace to persist the allocation table in, disabled when empty")
+	serverFlags.Duration("cert-validity", 365*24*time.Hour, "Validity of a generated certificate")
+	serverFlags.Duration("cert-rotate-before", 30*24*time.Hour, "Rotate a generated certificate this long before it expires")
+	serverFlags.String("reserved-ports", "", "NodePorts that are never handed out to any namespace, e.g. 30000-30010,30999. Added to the reserved list of port-range.yaml")
 
 	return serverFlags
 }
 
 func main() {
 	klog.InitFlags(nil)
+	serverFlags := NewServerFlagSet()
+	serverFlags.AddGoFlagSet(flag.CommandLine)
+	serverFlags.Parse(os.Args[1:])
 
 	ctx, cancel := context.WithCancel(context.TODO())
 	defer cancel()
 
 	stopCh := make(chan struct{})
 
-	// 从配置文件中加载配置
-	yamlConfig := config.LoadConfigFromFile(configFile)
 	// 初始化k8s客户端
 	k8sClient := k8s.BuildKubernetesClient()
+	// 从配置文件或者NodePortPool中加载配置
+	var cfg *config.Config
+	var dynamicClient dynamic.Interface
+	if source, _ := serverFlags.GetString("config-source"); source == "crd" {
+		dynamicClient = k8s.BuildDynamicClient()
+		cfg = crd.LoadConfigFromPools(dynamicClient)
+	} else {
+		cfg = config.LoadConfigFromFile(configFile)
+	}
+	if reservedPorts, _ := serverFlags.GetString("reserved-ports"); reservedPorts != "" {
+		reserved, err := config.ParsePortList(reservedPorts)
+		if err != nil {
+			klog.Fatalln("error parse --reserved-ports", err)
+		}
+		cfg.Reserved = append(cfg.Reserved, reserved...)
+	}
+	overrideDefault(serverFlags, cfg)
 	// 取出当前Pod的信息供leaderelection使用
 	k8s.GetPodInfo(k8sClient)
 	// 新建底层的存储，用于维护已分配和namespace的nodePort定义
 	s := store.NewNamespaceNodePortConfig()
-	// 运行leaderelection
-	go election.Election(k8sClient)
+	if ttl, err := serverFlags.GetDuration("reservation-ttl"); err == nil {
+		s.ReservationTTL = ttl
+	}
+	if cooldown, err := serverFlags.GetDuration("release-cooldown"); err == nil {
+		s.ReleaseCooldown = cooldown
+	}
+	if retention, err := serverFlags.GetDuration("sticky-retention"); err == nil {
+		s.StickyRetention = retention
+	}
+	// 证书由allocator自己生成时，注册webhook也使用同一个CA
+	var certManager *certs.Manager
+	if bootstrap, _ := serverFlags.GetBool("cert-bootstrap"); bootstrap {
+		certManager = newCertManager(serverFlags, k8sClient)
+	}
+
+	// 1. 从yaml中载入配置，组内共享范围的namespace使用同一个端口池
+	shared := make(map[string][]string)
+	sharedRanges := make(map[string]store.PortRanges)
+	dynamic := false
+	for _, config := range cfg.Namespaces {
+		ranges := toPortRanges(config.Ranges)
+		if config.Shared {
+			sharedRanges[config.Pool] = ranges
+			if !config.Dynamic() {
+				shared[config.Pool] = append(shared[config.Pool], config.Namespace)
+			}
+			continue
+		}
+		if err := s.AddNamespace(config.Namespace, ranges); err != nil {
+			klog.Warningf("namespace %s of group %s: %v", config.Namespace, config.Group, err)
+		}
+	}
+	for pool, ranges := range sharedRanges {
+		if err := s.AddSharedPool(pool, ranges, shared[pool]); err != nil {
+			klog.Warning(err)
+		}
+	}
+	s.SetReserved("", toPortRanges(cfg.Reserved))
+	for _, config := range cfg.Namespaces {
+		// glob或者selector匹配的namespace在第一次出现时绑定到端口池
+		if config.Dynamic() {
+			dynamic = true
+			if err := s.AddNamespaceMatcher(newMatcher(config)); err != nil {
+				klog.Warningf("namespace %s of group %s: %v", config.Namespace, config.Group, err)
+			}
+			continue
+		}
+		if len(config.Reserved) > 0 {
+			if err := s.SetReserved(config.Namespace, toPortRanges(config.Reserved)); err != nil {
+				klog.Warningf("namespace %s of group %s: %v", config.Namespace, config.Group, err)
+			}
+		}
+		if config.Strategy != "" {
+			allocator, err := store.NewAllocator(config.Strategy)
+			if err == nil {
+				err = s.SetAllocator(config.Namespace, allocator)
+			}
+			if err != nil {
+				klog.Warningf("namespace %s of group %s keeps the default allocation strategy: %v", config.Namespace, config.Group, err)
+			}
+		}
+		if config.MaxPorts == 0 && config.MinPorts == 0 {
+			continue
+		}
+		if err := s.SetQuota(config.Namespace, config.MinPorts, config.MaxPorts); err != nil {
+			klog.Warningf("namespace %s of group %s: %v", config.Namespace, config.Group, err)
+		}
+	}
+	if dynamic {
+		s.NamespaceLabels = k8s.NamespaceLabels(k8sClient, stopCh)
+	}
+	setDefaultPolicy(s, cfg)
+
+	// 运行leaderelection，由leader注册webhook并持久化分配表
+	var leaderFuncs []func(context.Context)
+	if register, _ := serverFlags.GetBool("register-webhook"); register {
+		leaderFuncs = append(leaderFuncs, newRegistrar(serverFlags, k8sClient, cfg.Namespaces, s.DefaultPolicy, certManager).Run)
+	}
 
-	// 1. 从yaml中载入配置
-	for _, config := range yamlConfig {
-		s.AddNamespace(config.Namespace, config.PortStart, config.PortEnd)
+	// 2. 从持久化的分配表恢复，没有则list namespaces and add allocated port to store
+	restored := false
+	if name, _ := serverFlags.GetString("persist-configmap"); name != "" {
+		backend := persist.NewConfigMapBackend(k8sClient, os.Getenv("POD_NAMESPACE"), name, s)
+		var err error
+		if restored, err = backend.Load(ctx); err != nil {
+			klog.Warningf("cannot restore allocations, fall back to listing services: %v", err)
+		}
+		leaderFuncs = append(leaderFuncs, backend.Run)
+	}
+	// 将分配表发布为NodePortClaim
+	if syncClaims, _ := serverFlags.GetBool("sync-claims"); syncClaims {
+		if dynamicClient == nil {
+			dynamicClient = k8s.BuildDynamicClient()
+		}
+		leaderFuncs = append(leaderFuncs, crd.NewClaimSyncer(dynamicClient, s).Run)
 	}
+	go election.Election(k8sClient, leaderFuncs...)
 
-	// 2. list namespaces and add allocated port to store
-	namespaces := k8s.ListNamespaces(k8sClient)
-	for _, namespace := range namespaces {
-		allocatedPorts := k8s.GetNamespacedAllocatedNodePort(k8sClient, namespace)
-		s.AddPortToNamespace(allocatedPorts.Namespace, allocatedPorts.NodePorts)
+	// 恢复后的分配表由informer与实际的service对账
+	if !restored {
+		namespaces := k8s.ListNamespaces(k8sClient)
+		for _, namespace := range namespaces {
+			for _, allocatedPorts := range k8s.GetNamespacedAllocatedNodePort(k8sClient, namespace) {
+				owner := store.OwnerKey(allocatedPorts.Namespace, allocatedPorts.Service)
+				if err := s.AddPortToNamespace(allocatedPorts.Namespace, owner, allocatedPorts.UID, allocatedPorts.NodePorts, allocatedPorts.Protocols); err != nil {
+					klog.Warning(err)
+				}
+			}
+		}
 	}
 
 	// 3. startqueue to watch the delete event of service
 	q := queue.NewQueue(k8sClient, stopCh, s)
 	go q.Run()
+	// 恢复的分配表缺少程序停止期间以及最后一次保存之后创建的service，开始分配之前等待informer确认所有service的端口
+	if !q.WaitForSync(stopCh) {
+		klog.Fatalln("stopped before the services were synced")
+	}
 
 	// 4. start webhook to mutating the creation and update of incoming service
-	hookServer := webhook.NewServer(ctx, *NewServerFlagSet(), s)
+	hookServer := webhook.NewServer(ctx, *serverFlags, s)
+	if certManager != nil {
+		if err := certManager.Run(ctx, stopCh); err != nil {
+			klog.Fatalln("error bootstrap serving certificate", err)
+		}
+		hookServer.UseCertificateSource(certManager.GetCertificate)
+	}
 	hookServer.Start()
 
 	sigCh := make(chan os.Signal, 1)
@@ -79,3 +232,141 @@ func main() {
 	}
 	os.Exit(0)
 }
+
+func newCertManager(serverFlags *pflag.FlagSet, client *kubernetes.Clientset) *certs.Manager {
+	secretName, _ := serverFlags.GetString("cert-secret-name")
+	serviceName, _ := serverFlags.GetString("service-name")
+	webhookConfigName, _ := serverFlags.GetString("webhook-config-name")
+	validity, _ := serverFlags.GetDuration("cert-validity")
+	rotateBefore, _ := serverFlags.GetDuration("cert-rotate-before")
+
+	return certs.NewManager(client, certs.Config{
+		Namespace:         os.Getenv("POD_NAMESPACE"),
+		ServiceName:       serviceName,
+		SecretName:        secretName,
+		WebhookConfigName: webhookConfigName,
+		Validity:          validity,
+		RotateBefore:      rotateBefore,
+	})
+}
+
+func newRegistrar(serverFlags *pflag.FlagSet, client *kubernetes.Clientset, yamlConfig config.Results, defaultPolicy store.DefaultPolicy, certManager *certs.Manager) *webhook.Registrar {
+	name, _ := serverFlags.GetString("webhook-config-name")
+	serviceName, _ := serverFlags.GetString("service-name")
+	servicePort, _ := serverFlags.GetInt32("service-port")
+	timeoutSeconds, _ := serverFlags.GetInt32("webhook-timeout-seconds")
+	policy, _ := serverFlags.GetString("webhook-failure-policy")
+	failurePolicy, err := webhook.ParseFailurePolicy(policy)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+
+	// glob或者selector匹配的namespace无法用namespaceSelector表示，默认策略不是allow时也需要处理所有namespace
+	var namespaces []string
+	allNamespaces := defaultPolicy != store.DefaultAllow
+	for _, result := range yamlConfig {
+		if result.Dynamic() {
+			allNamespaces = true
+			continue
+		}
+		namespaces = append(namespaces, result.Namespace)
+	}
+
+	var caBundle func() []byte
+	if certManager != nil {
+		caBundle = certManager.CABundle
+	} else if caFile, _ := serverFlags.GetString("tls-ca-file"); caFile != "" {
+		caBundle = func() []byte {
+			ca, err := os.ReadFile(caFile)
+			if err != nil {
+				klog.Warningf("cannot read %s: %v", caFile, err)
+			}
+			return ca
+		}
+	}
+
+	return webhook.NewRegistrar(client, webhook.RegistrationConfig{
+		Name:             name,
+		ServiceNamespace: os.Getenv("POD_NAMESPACE"),
+		ServiceName:      serviceName,
+		ServicePort:      servicePort,
+		Namespaces:       namespaces,
+		AllNamespaces:    allNamespaces,
+		FailurePolicy:    failurePolicy,
+		TimeoutSeconds:   timeoutSeconds,
+		CABundle:         caBundle,
+	})
+}
+
+// overrideDefault replaces the default policy of the configuration with the flags that were set
+func overrideDefault(serverFlags *pflag.FlagSet, cfg *config.Config) {
+	d := cfg.Default
+	changed := false
+	if serverFlags.Changed("default-policy") {
+		d.Policy, _ = serverFlags.GetString("default-policy")
+		changed = true
+	}
+	if serverFlags.Changed("default-node-port-range") {
+		d.NodePortRange, _ = serverFlags.GetString("default-node-port-range")
+		changed = true
+	}
+	if serverFlags.Changed("default-max-ports-per-namespace") {
+		d.MaxPortsPerNamespace, _ = serverFlags.GetInt("default-max-ports-per-namespace")
+		changed = true
+	}
+	if !changed {
+		return
+	}
+	if err := cfg.SetDefault(d); err != nil {
+		klog.Fatalln(err)
+	}
+}
+
+func setDefaultPolicy(s *store.NamespaceNodePortConfig, cfg *config.Config) {
+	policy, err := store.ParseDefaultPolicy(cfg.Default.Policy)
+	if err != nil {
+		klog.Fatalln(err)
+	}
+	s.DefaultPolicy = policy
+	if policy != store.DefaultCatchAll {
+		return
+	}
+
+	if err := s.SetCatchAll(toPortRanges(cfg.DefaultRanges), store.NamespaceMatcher{
+		Pool:     string(store.DefaultCatchAll),
+		Strategy: cfg.Default.Strategy,
+		MaxPorts: cfg.Default.MaxPortsPerNamespace,
+	}); err != nil {
+		klog.Fatalln("error set catch-all range", err)
+	}
+	klog.Infof("namespaces without a configured range share the catch-all range %s", cfg.Default.NodePortRange)
+}
+
+func newMatcher(result config.Result) store.NamespaceMatcher {
+	matcher := store.NamespaceMatcher{
+		Pattern:  result.Namespace,
+		Pool:     result.Pool,
+		Reserved: toPortRanges(result.Reserved),
+		Strategy: result.Strategy,
+		MaxPorts: result.MaxPorts,
+		MinPorts: result.MinPorts,
+	}
+	if result.Selector != "" {
+		// selector已经在解析配置时校验过
+		selector, err := labels.Parse(result.Selector)
+		if err != nil {
+			klog.Warningf("bad namespaceSelector %s: %v", result.Selector, err)
+			selector = labels.Nothing()
+		}
+		matcher.Selector = selector
+	}
+	return matcher
+}
+
+func toPortRanges(ranges []config.PortRange) store.PortRanges {
+	var portRanges store.PortRanges
+	for _, r := range ranges {
+		portRanges = append(portRanges, store.PortRange{Min: r.Start, Max: r.End})
+	}
+	return portRanges
+}
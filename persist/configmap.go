@@ -0,0 +1,187 @@
+package persist
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/tiggoins/port-allocator/store"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// allocationsKey is the ConfigMap key holding the allocation table. A confirmed allocation
+	// takes about 200 bytes, so the default nodePort range of 2768 ports alone needs about
+	// 550 KB and larger ranges or many sticky ports can reach the ConfigMap size limit.
+	// Save fails with an error naming the sizes instead of writing a truncated table.
+	allocationsKey = "allocations.json"
+
+	// cooldownsKey holds the released ports that are still cooling down
+	cooldownsKey = "cooldowns.json"
+
+	// stickyKey holds the ports remembered for deleted services
+	stickyKey = "sticky.json"
+
+	// savePeriod is how often the leader writes the table when it changed
+	savePeriod = 10 * time.Second
+)
+
+// ConfigMapBackend keeps the allocation table of the store in a ConfigMap
+type ConfigMapBackend struct {
+	client    kubernetes.Interface
+	namespace string
+	name      string
+	s         *store.NamespaceNodePortConfig
+	// saved is the last data written, used to skip writes when nothing changed
+	saved map[string]string
+}
+
+func NewConfigMapBackend(client kubernetes.Interface, namespace, name string, s *store.NamespaceNodePortConfig) *ConfigMapBackend {
+	return &ConfigMapBackend{client: client, namespace: namespace, name: name, s: s}
+}
+
+// Load restores the allocation table into the store, it returns false when no table was saved yet
+func (b *ConfigMapBackend) Load(ctx context.Context) (bool, error) {
+	cm, err := b.client.CoreV1().ConfigMaps(b.namespace).Get(ctx, b.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("get configmap %s/%s: %v", b.namespace, b.name, err)
+	}
+
+	// 冷却记录与分配表分开保存，没有分配表时也恢复
+	if data, ok := cm.Data[cooldownsKey]; ok {
+		var cooldowns []store.Cooldown
+		if err := json.Unmarshal([]byte(data), &cooldowns); err != nil {
+			klog.Warningf("cannot decode cooldowns of configmap %s/%s: %v", b.namespace, b.name, err)
+		} else {
+			klog.Infof("restored %d of %d cooldowns from configmap %s/%s", b.s.RestoreCooldowns(cooldowns), len(cooldowns), b.namespace, b.name)
+		}
+	}
+
+	if data, ok := cm.Data[stickyKey]; ok {
+		var stickyPorts []store.StickyPort
+		if err := json.Unmarshal([]byte(data), &stickyPorts); err != nil {
+			klog.Warningf("cannot decode sticky ports of configmap %s/%s: %v", b.namespace, b.name, err)
+		} else {
+			klog.Infof("restored %d of %d sticky ports from configmap %s/%s", b.s.RestoreStickyPorts(stickyPorts), len(stickyPorts), b.namespace, b.name)
+		}
+	}
+
+	data, ok := cm.Data[allocationsKey]
+	if !ok {
+		return false, nil
+	}
+
+	var allocations []store.Allocation
+	if err := json.Unmarshal([]byte(data), &allocations); err != nil {
+		return false, fmt.Errorf("decode allocation table of configmap %s/%s: %v", b.namespace, b.name, err)
+	}
+	restored := b.s.Restore(allocations)
+	klog.Infof("restored %d of %d allocations from configmap %s/%s", restored, len(allocations), b.namespace, b.name)
+
+	return true, nil
+}
+
+// Run writes the allocation table whenever it changed until ctx is done, it is meant to
+// run on the leader only
+func (b *ConfigMapBackend) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := b.Save(ctx); err != nil {
+			klog.Errorf("failed to persist allocation table: %v", err)
+		}
+	}, savePeriod)
+}
+
+// Save writes the current allocation table, cooldowns and sticky ports. The update carries the
+// resourceVersion that was read, so a concurrent writer makes it fail and the next round retries.
+func (b *ConfigMapBackend) Save(ctx context.Context) error {
+	allocations, err := json.Marshal(b.s.Snapshot())
+	if err != nil {
+		return err
+	}
+	cooldowns, err := json.Marshal(b.s.Cooldowns())
+	if err != nil {
+		return err
+	}
+	stickyPorts, err := json.Marshal(b.s.StickyPorts())
+	if err != nil {
+		return err
+	}
+	data := map[string]string{
+		allocationsKey: string(allocations),
+		cooldownsKey:   string(cooldowns),
+		stickyKey:      string(stickyPorts),
+	}
+	if unchanged(b.saved, data) {
+		return nil
+	}
+
+	configMaps := b.client.CoreV1().ConfigMaps(b.namespace)
+	cm, err := configMaps.Get(ctx, b.name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		cm = &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: b.name, Namespace: b.namespace},
+			Data:       data,
+		}
+		if err := b.checkSize(cm.Data); err != nil {
+			return err
+		}
+		if _, err := configMaps.Create(ctx, cm, metav1.CreateOptions{}); err != nil {
+			return err
+		}
+		b.saved = data
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cm = cm.DeepCopy()
+	if cm.Data == nil {
+		cm.Data = make(map[string]string)
+	}
+	for key, value := range data {
+		cm.Data[key] = value
+	}
+	if err := b.checkSize(cm.Data); err != nil {
+		return err
+	}
+	if _, err := configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return err
+	}
+	b.saved = data
+	klog.V(2).Infof("persisted allocation table to configmap %s/%s", b.namespace, b.name)
+
+	return nil
+}
+
+// checkSize returns an error when data does not fit into a ConfigMap, the apiserver would
+// reject the update with a less helpful message
+func (b *ConfigMapBackend) checkSize(data map[string]string) error {
+	total := 0
+	for key, value := range data {
+		total += len(key) + len(value)
+	}
+	if total <= corev1.MaxSecretSize {
+		return nil
+	}
+	return fmt.Errorf("allocation table of configmap %s/%s needs %d bytes (allocations %d, cooldowns %d, sticky ports %d), more than the %d bytes a configmap can hold",
+		b.namespace, b.name, total, len(data[allocationsKey]), len(data[cooldownsKey]), len(data[stickyKey]), corev1.MaxSecretSize)
+}
+
+func unchanged(saved, data map[string]string) bool {
+	for key, value := range data {
+		if saved[key] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -2,8 +2,10 @@ package queue
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
+	"github.com/tiggoins/port-allocator/k8s"
 	"github.com/tiggoins/port-allocator/store"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -16,18 +18,32 @@ import (
 	"k8s.io/klog/v2"
 )
 
-// Event holds the context of an event.
-type Event struct {
-	Namespace string
-	Ports     []int32
+// release holds the nodePorts a service stopped using, because it was deleted or updated. Releases are recorded by the
+// event handlers and applied by the worker that handles the key of the service.
+type release struct {
+	namespace string
+	// owner 为service的namespace/name
+	owner string
+	uid   string
+	ports []int32
 }
 
-// Informer defines the required SharedIndexInformers that interact with the API server.
+// reservationCheckPeriod is how often expired reservations are released
+const reservationCheckPeriod = 10 * time.Second
+
+// Queue reconciles the store with the services seen by the informer. Services are queued by
+// their namespace/name key, the workqueue never hands the same key to two workers, so the
+// events of one service are handled in order.
 type Queue struct {
 	informer  cache.SharedInformer
 	workqueue workqueue.RateLimitingInterface
 	stopCh    chan struct{}
 	s         *store.NamespaceNodePortConfig
+	// 按service key记录删除或者更新后待释放的端口
+	lock     sync.Mutex
+	releases map[string][]release
+	// informer同步完成并确认了所有service的端口后关闭
+	synced chan struct{}
 }
 
 func NewQueue(kubeClient *kubernetes.Clientset, stopCh chan struct{}, ss *store.NamespaceNodePortConfig) *Queue {
@@ -36,45 +52,102 @@ func NewQueue(kubeClient *kubernetes.Clientset, stopCh chan struct{}, ss *store.
 
 	rq := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
 
-	queue := &Queue{informer: informer, workqueue: rq, stopCh: stopCh, s: ss}
+	queue := &Queue{informer: informer, workqueue: rq, stopCh: stopCh, s: ss, releases: make(map[string][]release), synced: make(chan struct{})}
 
-	go queue.watchDeleteEvent(queue.stopCh)
+	go queue.watchEvents(queue.stopCh)
 
 	return queue
 }
 
-func (queue *Queue) watchDeleteEvent(stopCh chan struct{}) {
+func (queue *Queue) watchEvents(stopCh chan struct{}) {
 	go queue.informer.Run(stopCh)
 
 	if !cache.WaitForCacheSync(stopCh, queue.informer.HasSynced) {
 		runtime.HandleError(fmt.Errorf("timed out waiting for caches to sync"))
+	} else {
+		queue.releaseStale()
+		queue.confirmListed()
+		close(queue.synced)
 	}
 
 	queue.informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			queue.enqueue(obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldService, ok := oldObj.(*corev1.Service)
+			newService, ok2 := newObj.(*corev1.Service)
+			// skip periodic resyncs
+			if ok && ok2 && oldService.ResourceVersion == newService.ResourceVersion {
+				return
+			}
+			// 更新被apiserver接受后才释放被移除的端口，包括改为ClusterIP的service的所有端口
+			if ok && ok2 {
+				queue.enqueueRelease(oldService, k8s.RemovedNodePorts(oldService, newService))
+			}
+			queue.enqueue(newObj)
+		},
 		DeleteFunc: func(obj interface{}) {
-			var event Event
-			if service, ok := obj.(*corev1.Service); ok {
-				if service.Spec.Type == corev1.ServiceTypeNodePort {
-					for _, ports := range service.Spec.Ports {
-						event.Ports = append(event.Ports, ports.NodePort)
-					}
-					event.Namespace = service.Namespace
-				}
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			service, ok := obj.(*corev1.Service)
+			if !ok || !k8s.ConsumesNodePorts(service) {
+				return
 			}
-			queue.workqueue.AddRateLimited(event)
+			queue.enqueueRelease(service, k8s.ServiceNodePorts(service))
 		},
 	})
 }
 
+func (queue *Queue) enqueue(obj interface{}) {
+	service, ok := obj.(*corev1.Service)
+	if !ok || !k8s.ConsumesNodePorts(service) {
+		return
+	}
+
+	key, err := cache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	queue.workqueue.Add(key)
+}
+
+// enqueueRelease records ports the service stopped using and queues the service
+func (queue *Queue) enqueueRelease(service *corev1.Service, ports []int32) {
+	if len(ports) == 0 {
+		return
+	}
+	key, err := cache.MetaNamespaceKeyFunc(service)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+
+	queue.lock.Lock()
+	queue.releases[key] = append(queue.releases[key], release{
+		namespace: service.Namespace,
+		owner:     store.OwnerKey(service.Namespace, service.Name),
+		uid:       string(service.UID),
+		ports:     ports,
+	})
+	queue.lock.Unlock()
+
+	queue.workqueue.Add(key)
+}
+
 // run 运行控制器,从workqueue从取出数据交给worker处理
 func (queue *Queue) Run() {
 	defer queue.workqueue.ShutDown()
 
-	klog.Info("start controller to watch the delete event of service.")
+	klog.Info("start controller to watch the events of service.")
 	// 开启工作协程
 	for i := 0; i < 2; i++ {
 		go wait.Until(queue.worker, time.Second, queue.stopCh)
 	}
+	// 定期释放过期未确认的端口，并结束冷却完成的端口
+	go wait.Until(queue.expireReservations, reservationCheckPeriod, queue.stopCh)
 
 	<-queue.stopCh
 	klog.Info("Controller stopped")
@@ -83,20 +156,116 @@ func (queue *Queue) Run() {
 // worker 工作者函数，用于处理 DeltaFIFO 中的事件
 func (queue *Queue) worker() {
 	for {
-		key, shutdown := queue.workqueue.Get()
+		item, shutdown := queue.workqueue.Get()
 		if shutdown {
 			klog.Info("Error getting item from FIFO")
 			return
 		}
 
-		event, ok := key.(Event)
+		key, ok := item.(string)
 		if !ok {
-			klog.Warningln("get a key from workqueue but not Event type.ignore")
+			klog.Warningln("get a key from workqueue but not string type.ignore")
+			queue.workqueue.Done(item)
 			continue
 		}
 
-		queue.s.RemovePortFromAPI(event.Namespace, event.Ports)
+		queue.sync(key)
+		queue.workqueue.Forget(item)
+		queue.workqueue.Done(item)
+	}
+}
+
+// sync 先释放service不再使用的端口，再按informer中当前的对象确认端口
+func (queue *Queue) sync(key string) {
+	queue.lock.Lock()
+	releases := queue.releases[key]
+	delete(queue.releases, key)
+	queue.lock.Unlock()
+
+	for _, r := range releases {
+		if err := queue.s.ReleasePorts(r.namespace, r.owner, r.uid, r.ports); err != nil {
+			klog.V(4).Info(err)
+		}
+	}
+
+	obj, exists, err := queue.informer.GetStore().GetByKey(key)
+	if err != nil {
+		runtime.HandleError(err)
+		return
+	}
+	if !exists {
+		return
+	}
+	if service, ok := obj.(*corev1.Service); ok && k8s.ConsumesNodePorts(service) {
+		queue.confirm(service)
+	}
+}
+
+// confirm 确认service使用的端口，并按端口名称记录，用于删除后重建时分配相同的端口
+func (queue *Queue) confirm(service *corev1.Service) {
+	owner := store.OwnerKey(service.Namespace, service.Name)
+	if err := queue.s.ConfirmPorts(service.Namespace, owner, string(service.UID), k8s.ServiceNodePorts(service), k8s.NodePortProtocols(service)); err != nil {
+		klog.V(4).Info(err)
+	}
+	queue.s.RememberPorts(service.Namespace, owner, k8s.NamedNodePorts(service))
+}
+
+func (queue *Queue) expireReservations() {
+	if expired := queue.s.ExpireReservations(time.Now()); expired > 0 {
+		klog.Infof("released %d nodePorts whose services never showed up", expired)
+	}
+	if cooled := queue.s.ExpireCooldowns(time.Now()); cooled > 0 {
+		klog.V(2).Infof("%d released nodePorts finished cooling down", cooled)
+	}
+	if forgotten := queue.s.ExpireStickyPorts(time.Now()); forgotten > 0 {
+		klog.V(2).Infof("forgot %d nodePorts of deleted services whose retention expired", forgotten)
+	}
+}
+
+// releaseStale releases the ports of services that were deleted or changed their ports while
+// the allocator was not watching, and flags services already using reserved ports
+func (queue *Queue) releaseStale() {
+	live := make(map[string]store.LiveService)
+	for _, obj := range queue.informer.GetStore().List() {
+		if service, ok := obj.(*corev1.Service); ok {
+			live[store.OwnerKey(service.Namespace, service.Name)] = store.LiveService{
+				UID:   string(service.UID),
+				Ports: k8s.ServiceNodePorts(service),
+			}
+			queue.flagReserved(service)
+		}
+	}
+
+	if released := queue.s.ReleaseStale(live); released > 0 {
+		klog.Infof("released %d nodePorts that no service uses anymore", released)
+	}
+}
 
-		queue.workqueue.Done(key)
+// confirmListed confirms the ports of every service the informer listed, services created while
+// the allocator was down are missing from a restored table
+func (queue *Queue) confirmListed() {
+	for _, obj := range queue.informer.GetStore().List() {
+		if service, ok := obj.(*corev1.Service); ok && k8s.ConsumesNodePorts(service) {
+			queue.confirm(service)
+		}
+	}
+}
+
+// WaitForSync blocks until the informer synced and the ports of every listed service are in
+// the store, it returns false when stopCh is closed first
+func (queue *Queue) WaitForSync(stopCh <-chan struct{}) bool {
+	select {
+	case <-queue.synced:
+		return true
+	case <-stopCh:
+		return false
+	}
+}
+
+func (queue *Queue) flagReserved(service *corev1.Service) {
+	for _, port := range k8s.ServiceNodePorts(service) {
+		if queue.s.IsReserved(service.Namespace, port) {
+			klog.Warningf("service %s/%s already uses reserved nodePort %d", service.Namespace, service.Name, port)
+		}
 	}
 }
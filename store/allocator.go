@@ -0,0 +1,136 @@
+package store
+
+import (
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// Allocation strategies selectable per namespace or pool
+const (
+	StrategyFirstFit              = "first-fit"
+	StrategyRandom                = "random"
+	StrategyLeastRecentlyReleased = "least-recently-released"
+	StrategyRoundRobin            = "round-robin"
+)
+
+// PortSet is the view of a port pool an Allocator picks from
+type PortSet interface {
+	// Ranges returns the sorted segments of the pool
+	Ranges() PortRanges
+	// NextFree returns the first free port at or after from, wrapping around the segments
+	// once. Ports for which skip returns true are treated as used.
+	NextFree(from int32, skip func(int32) bool) (int32, bool)
+	// ReleasedAt returns when port was released last, zero if it never was
+	ReleasedAt(port int32) time.Time
+}
+
+// Allocator decides which free port of a pool is handed out next. It is called with the
+// store locked, so implementations need no locking of their own.
+type Allocator interface {
+	// Pick returns the next port to hand out without taking it, dry-runs only call Pick
+	Pick(ports PortSet, skip func(int32) bool) (int32, bool)
+	// Allocated is called once the port returned by Pick was handed out
+	Allocated(port int32)
+}
+
+// NewAllocator returns the built-in Allocator for strategy, the empty strategy is round-robin
+func NewAllocator(strategy string) (Allocator, error) {
+	switch strategy {
+	case StrategyFirstFit:
+		return firstFit{}, nil
+	case StrategyRandom:
+		return randomFit{}, nil
+	case StrategyLeastRecentlyReleased:
+		return leastRecentlyReleased{}, nil
+	case StrategyRoundRobin, "":
+		return &roundRobin{}, nil
+	}
+	return nil, fmt.Errorf("unknown allocation strategy %q", strategy)
+}
+
+// firstFit always hands out the lowest free port
+type firstFit struct{}
+
+func (firstFit) Pick(ports PortSet, skip func(int32) bool) (int32, bool) {
+	ranges := ports.Ranges()
+	if len(ranges) == 0 {
+		return 0, false
+	}
+	return ports.NextFree(ranges[0].Min, skip)
+}
+
+func (firstFit) Allocated(int32) {}
+
+// randomFit starts searching at a random port, spreading the ports of a namespace
+// over the whole range
+type randomFit struct{}
+
+func (randomFit) Pick(ports PortSet, skip func(int32) bool) (int32, bool) {
+	ranges := ports.Ranges()
+	size := int32(0)
+	for _, pr := range ranges {
+		size += pr.Max - pr.Min + 1
+	}
+	if size <= 0 {
+		return 0, false
+	}
+
+	// 把随机偏移映射到对应端口段中的端口
+	offset := rand.Int31n(size)
+	for _, pr := range ranges {
+		if n := pr.Max - pr.Min + 1; offset >= n {
+			offset -= n
+			continue
+		}
+		return ports.NextFree(pr.Min+offset, skip)
+	}
+	return 0, false
+}
+
+func (randomFit) Allocated(int32) {}
+
+// leastRecentlyReleased hands out the free port released longest ago, ports that were
+// never released come first
+type leastRecentlyReleased struct{}
+
+func (leastRecentlyReleased) Pick(ports PortSet, skip func(int32) bool) (int32, bool) {
+	ranges := ports.Ranges()
+	if len(ranges) == 0 {
+		return 0, false
+	}
+
+	port, ok := ports.NextFree(ranges[0].Min, skip)
+	if !ok {
+		return 0, false
+	}
+	best, bestAt := port, ports.ReleasedAt(port)
+	for !bestAt.IsZero() {
+		// NextFree回绕到起点之前的端口时说明所有空闲端口都已检查过
+		next, ok := ports.NextFree(port+1, skip)
+		if !ok || next <= port {
+			break
+		}
+		port = next
+		if at := ports.ReleasedAt(port); at.Before(bestAt) {
+			best, bestAt = port, at
+		}
+	}
+	return best, true
+}
+
+func (leastRecentlyReleased) Allocated(int32) {}
+
+// roundRobin continues after the port handed out last, so that a released port is only
+// reused once the rest of the range was handed out
+type roundRobin struct {
+	next int32
+}
+
+func (r *roundRobin) Pick(ports PortSet, skip func(int32) bool) (int32, bool) {
+	return ports.NextFree(r.next, skip)
+}
+
+func (r *roundRobin) Allocated(port int32) {
+	r.next = port + 1
+}
@@ -0,0 +1,141 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestPool returns a pool of two segments with a gap in between, holding used
+func newTestPool(used ...int32) *portPool {
+	pool := newPortPool(PortRanges{{Min: 30000, Max: 30004}, {Min: 30010, Max: 30014}})
+	for _, port := range used {
+		pool.take("a", port, "a/svc", "", time.Time{})
+	}
+	return pool
+}
+
+func TestLeastRecentlyReleasedPick(t *testing.T) {
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		used     []int32
+		released map[int32]time.Duration
+		skip     func(int32) bool
+		want     int32
+		wantOK   bool
+	}{
+		{
+			name: "never released ports come first",
+			want: 30000, wantOK: true,
+		},
+		{
+			name:     "never released port after released ones",
+			released: map[int32]time.Duration{30000: 3, 30001: 1},
+			want:     30002, wantOK: true,
+		},
+		{
+			name: "oldest release across the gap",
+			used: []int32{30003, 30004},
+			released: map[int32]time.Duration{
+				30000: 5, 30001: 4, 30002: 6,
+				30010: 3, 30011: 1, 30012: 2, 30013: 7, 30014: 8,
+			},
+			want: 30011, wantOK: true,
+		},
+		{
+			name: "oldest release is the last port",
+			released: map[int32]time.Duration{
+				30000: 9, 30001: 8, 30002: 7, 30003: 6, 30004: 5,
+				30010: 4, 30011: 3, 30012: 2, 30013: 2, 30014: 1,
+			},
+			want: 30014, wantOK: true,
+		},
+		{
+			name:     "single free port stops the wrap around",
+			used:     []int32{30000, 30001, 30002, 30003, 30004, 30010, 30011, 30013, 30014},
+			released: map[int32]time.Duration{30012: 1},
+			want:     30012, wantOK: true,
+		},
+		{
+			name:     "skipped ports are not picked",
+			released: map[int32]time.Duration{30000: 2, 30001: 1, 30010: 3},
+			skip:     func(port int32) bool { return port != 30000 && port != 30010 },
+			want:     30000, wantOK: true,
+		},
+		{
+			name:   "skip covers every free port",
+			used:   []int32{30000, 30001, 30002},
+			skip:   func(port int32) bool { return true },
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.used...)
+			for port, at := range tt.released {
+				pool.releasedAt[port] = base.Add(at * time.Minute)
+			}
+			got, ok := leastRecentlyReleased{}.Pick(pool, tt.skip)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("Pick() = %d, %t, want %d, %t", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestRandomFitPick(t *testing.T) {
+	tests := []struct {
+		name string
+		used []int32
+		skip func(int32) bool
+		// want holds every port the picks may return, nil when no port can be picked
+		want map[int32]bool
+	}{
+		{
+			name: "every port of both segments and none of the gap",
+			want: map[int32]bool{
+				30000: true, 30001: true, 30002: true, 30003: true, 30004: true,
+				30010: true, 30011: true, 30012: true, 30013: true, 30014: true,
+			},
+		},
+		{
+			name: "single free port in the second segment",
+			used: []int32{30000, 30001, 30002, 30003, 30004, 30010, 30011, 30013, 30014},
+			want: map[int32]bool{30012: true},
+		},
+		{
+			name: "single free port in the first segment",
+			used: []int32{30000, 30002, 30003, 30004, 30010, 30011, 30012, 30013, 30014},
+			want: map[int32]bool{30001: true},
+		},
+		{
+			name: "skip covers every free port",
+			used: []int32{30000, 30001},
+			skip: func(port int32) bool { return true },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newTestPool(tt.used...)
+			seen := make(map[int32]bool)
+			for i := 0; i < 2000; i++ {
+				got, ok := randomFit{}.Pick(pool, tt.skip)
+				if ok != (tt.want != nil) {
+					t.Fatalf("Pick() = %d, %t, want ok %t", got, ok, tt.want != nil)
+				}
+				if !ok {
+					continue
+				}
+				if !tt.want[got] {
+					t.Fatalf("Pick() = %d, not one of %v", got, tt.want)
+				}
+				seen[got] = true
+			}
+			if len(seen) != len(tt.want) {
+				t.Errorf("picked %v, want every port of %v", seen, tt.want)
+			}
+		})
+	}
+}
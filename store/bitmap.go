@@ -0,0 +1,86 @@
+package store
+
+import "math/bits"
+
+// portBitmap tracks the ports of a PortRange, bit i set means port base+i is in use
+type portBitmap struct {
+	base  int32
+	size  int32
+	words []uint64
+}
+
+func newPortBitmap(r PortRange) *portBitmap {
+	size := r.Max - r.Min + 1
+	return &portBitmap{
+		base:  r.Min,
+		size:  size,
+		words: make([]uint64, (size+63)/64),
+	}
+}
+
+func (b *portBitmap) contains(port int32) bool {
+	return port >= b.base && port < b.base+b.size
+}
+
+func (b *portBitmap) isSet(port int32) bool {
+	if !b.contains(port) {
+		return false
+	}
+	offset := port - b.base
+	return b.words[offset/64]&(1<<(uint(offset)%64)) != 0
+}
+
+func (b *portBitmap) set(port int32) {
+	if !b.contains(port) {
+		return
+	}
+	offset := port - b.base
+	b.words[offset/64] |= 1 << (uint(offset) % 64)
+}
+
+func (b *portBitmap) clear(port int32) {
+	if !b.contains(port) {
+		return
+	}
+	offset := port - b.base
+	b.words[offset/64] &^= 1 << (uint(offset) % 64)
+}
+
+// nextFree returns the first free port between the offsets start and end, end excluded.
+// Ports for which skip returns true are treated as used.
+func (b *portBitmap) nextFree(start, end int32, skip func(int32) bool) (int32, bool) {
+	if end > b.size {
+		end = b.size
+	}
+
+	// 按字扫描，跳过已满的字
+	for offset := start; offset < end; {
+		word := offset / 64
+		bit := uint(offset) % 64
+		free := ^b.words[word] >> bit
+		if remaining := end - word*64; remaining < 64 {
+			free &= (uint64(1)<<uint(remaining) - 1) >> bit
+		}
+		if free == 0 {
+			offset += 64 - int32(bit)
+			continue
+		}
+
+		candidate := offset + int32(bits.TrailingZeros64(free))
+		if skip == nil || !skip(b.base+candidate) {
+			return b.base + candidate, true
+		}
+		offset = candidate + 1
+	}
+
+	return 0, false
+}
+
+// used returns the number of ports in use
+func (b *portBitmap) used() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
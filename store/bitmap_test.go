@@ -0,0 +1,219 @@
+package store
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// newTestBitmap returns a bitmap for 30000-30129, three words with only two bits used in the last
+func newTestBitmap(used ...int32) *portBitmap {
+	b := newPortBitmap(PortRange{Min: 30000, Max: 30129})
+	for _, port := range used {
+		b.set(port)
+	}
+	return b
+}
+
+// usedRange returns the ports from min to max
+func usedRange(min, max int32) []int32 {
+	var ports []int32
+	for port := min; port <= max; port++ {
+		ports = append(ports, port)
+	}
+	return ports
+}
+
+func TestBitmapNextFree(t *testing.T) {
+	tests := []struct {
+		name       string
+		used       []int32
+		start, end int32
+		skip       func(int32) bool
+		want       int32
+		wantOK     bool
+	}{
+		{
+			name: "empty bitmap", start: 0, end: 130,
+			want: 30000, wantOK: true,
+		},
+		{
+			name: "first word full", used: usedRange(30000, 30063), start: 0, end: 130,
+			want: 30064, wantOK: true,
+		},
+		{
+			name: "last bit of a word", used: usedRange(30000, 30062), start: 0, end: 130,
+			want: 30063, wantOK: true,
+		},
+		{
+			name: "start inside a word ignores lower bits", start: 10, end: 130,
+			want: 30010, wantOK: true,
+		},
+		{
+			name: "start inside a word crosses into the next", used: usedRange(30060, 30063), start: 60, end: 130,
+			want: 30064, wantOK: true,
+		},
+		{
+			name: "end inside a word masks higher bits", used: usedRange(30064, 30069), start: 64, end: 70,
+			wantOK: false,
+		},
+		{
+			name: "end excluded", used: usedRange(30000, 30009), start: 0, end: 10,
+			wantOK: false,
+		},
+		{
+			name: "start and end in the same word", used: usedRange(30070, 30074), start: 70, end: 76,
+			want: 30075, wantOK: true,
+		},
+		{
+			name: "unused bits of the last word are not free", used: usedRange(30000, 30129), start: 0, end: 130,
+			wantOK: false,
+		},
+		{
+			name: "last port of a partial word", used: usedRange(30000, 30128), start: 0, end: 130,
+			want: 30129, wantOK: true,
+		},
+		{
+			name: "end beyond the size is clamped", used: usedRange(30000, 30129), start: 128, end: 1000,
+			wantOK: false,
+		},
+		{
+			name: "skipped ports are treated as used", used: usedRange(30000, 30063), start: 0, end: 130,
+			skip: func(port int32) bool { return port < 30100 },
+			want: 30100, wantOK: true,
+		},
+		{
+			name: "everything skipped", start: 0, end: 130,
+			skip:   func(int32) bool { return true },
+			wantOK: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBitmap(tt.used...)
+			got, ok := b.nextFree(tt.start, tt.end, tt.skip)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("nextFree(%d, %d) = %d, %t, want %d, %t", tt.start, tt.end, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestPortPoolNextFree(t *testing.T) {
+	ranges := PortRanges{{Min: 30100, Max: 30109}, {Min: 30000, Max: 30009}}
+	tests := []struct {
+		name   string
+		used   []int32
+		from   int32
+		skip   func(int32) bool
+		want   int32
+		wantOK bool
+	}{
+		{
+			name: "from inside a segment", from: 30005,
+			want: 30005, wantOK: true,
+		},
+		{
+			name: "from in the gap starts at the next segment", from: 30050,
+			want: 30100, wantOK: true,
+		},
+		{
+			name: "from below every segment", from: 100,
+			want: 30000, wantOK: true,
+		},
+		{
+			name: "from beyond every segment wraps to the first", from: 31000,
+			want: 30000, wantOK: true,
+		},
+		{
+			name: "end of a segment moves to the next", used: usedRange(30005, 30009), from: 30005,
+			want: 30100, wantOK: true,
+		},
+		{
+			name: "end of the last segment wraps around", used: usedRange(30105, 30109), from: 30105,
+			want: 30000, wantOK: true,
+		},
+		{
+			name: "wrap stops before from", used: append(usedRange(30000, 30009), usedRange(30100, 30109)...),
+			from: 30105, wantOK: false,
+		},
+		{
+			name: "wrap reaches the ports before from in the same segment",
+			used: append(append(usedRange(30000, 30001), usedRange(30003, 30009)...), usedRange(30100, 30109)...),
+			from: 30005, want: 30002, wantOK: true,
+		},
+		{
+			name: "skipped ports are treated as used", from: 30000,
+			skip: func(port int32) bool { return port < 30105 },
+			want: 30105, wantOK: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := newPortPool(ranges)
+			for _, port := range tt.used {
+				pool.take("a", port, "a/svc", "", time.Time{})
+			}
+			got, ok := pool.NextFree(tt.from, tt.skip)
+			if ok != tt.wantOK || (ok && got != tt.want) {
+				t.Errorf("NextFree(%d) = %d, %t, want %d, %t", tt.from, got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+// newNearlyFullStore returns a store with namespaces sharing 30000-32767, every port but the
+// last free ones is held by a service of the first namespace
+func newNearlyFullStore(b *testing.B, namespaces, free int) *NamespaceNodePortConfig {
+	c := NewNamespaceNodePortConfig()
+	names := make([]string, namespaces)
+	for i := range names {
+		names[i] = fmt.Sprintf("ns-%d", i)
+	}
+	if err := c.AddSharedPool("shared", PortRanges{{Min: 30000, Max: 32767}}, names); err != nil {
+		b.Fatal(err)
+	}
+	if err := c.ConfirmPorts("ns-0", "ns-0/full", "uid", usedRange(30000, 32767-int32(free)), nil); err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+func BenchmarkAllocatePorts(b *testing.B) {
+	for _, bench := range []struct {
+		name       string
+		namespaces int
+	}{
+		{name: "1 namespace", namespaces: 1},
+		{name: "5000 namespaces", namespaces: 5000},
+	} {
+		for _, strategy := range []string{StrategyRoundRobin, StrategyFirstFit, StrategyRandom} {
+			b.Run(bench.name+"/"+strategy, func(b *testing.B) {
+				c := newNearlyFullStore(b, bench.namespaces, 8)
+				namespace := fmt.Sprintf("ns-%d", bench.namespaces-1)
+				allocator, err := NewAllocator(strategy)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if err := c.SetAllocator(namespace, allocator); err != nil {
+					b.Fatal(err)
+				}
+				owner := OwnerKey(namespace, "svc")
+				requests := []PortRequest{{Name: "http"}}
+
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					ports, err := c.AllocatePorts(namespace, owner, requests, false)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := c.ReleasePorts(namespace, owner, "", ports); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// Cooldown records a released port that is not handed out again before Until, so that
+// firewalls and clients still using the old port do not hit an unrelated service
+type Cooldown struct {
+	Namespace string    `json:"namespace"`
+	Port      int32     `json:"port"`
+	Until     time.Time `json:"until"`
+}
+
+// releasePort 释放端口，已确认的端口在ReleaseCooldown内不会被自动分配，并开始保留给原来的service
+func (c *NamespaceNodePortConfig) releasePort(pool *portPool, port int32) {
+	alloc, ok := pool.Allocations[port]
+	pool.release(port)
+	// 未被确认的端口没有被使用过，不需要冷却
+	if !ok || alloc.Reserved() {
+		return
+	}
+
+	now := time.Now()
+	c.stickyReleased(alloc.Owner, port, now)
+	if c.ReleaseCooldown > 0 {
+		pool.cooldown[port] = Cooldown{Namespace: alloc.Namespace, Port: port, Until: now.Add(c.ReleaseCooldown)}
+	}
+}
+
+// ExpireCooldowns 清理在now之前结束的冷却记录，返回清理的数量
+func (c *NamespaceNodePortConfig) ExpireCooldowns(now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expired := 0
+	for _, pool := range c.pools {
+		for port, cooldown := range pool.cooldown {
+			if now.Before(cooldown.Until) {
+				continue
+			}
+			delete(pool.cooldown, port)
+			expired++
+		}
+	}
+
+	return expired
+}
+
+// Cooldowns returns a copy of every port still cooling down, sorted by namespace and port
+func (c *NamespaceNodePortConfig) Cooldowns() []Cooldown {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var cooldowns []Cooldown
+	for _, pool := range c.pools {
+		for _, cooldown := range pool.cooldown {
+			cooldowns = append(cooldowns, cooldown)
+		}
+	}
+
+	sort.Slice(cooldowns, func(i, j int) bool {
+		if cooldowns[i].Namespace != cooldowns[j].Namespace {
+			return cooldowns[i].Namespace < cooldowns[j].Namespace
+		}
+		return cooldowns[i].Port < cooldowns[j].Port
+	})
+
+	return cooldowns
+}
+
+// RestoreCooldowns 恢复持久化的冷却记录，已结束、不在范围内或者已被重新分配的端口被忽略
+func (c *NamespaceNodePortConfig) RestoreCooldowns(cooldowns []Cooldown) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	restored := 0
+	for _, cooldown := range cooldowns {
+		nsConfig, ok := c.getNamespace(cooldown.Namespace)
+		if !ok || !nsConfig.inRange(cooldown.Port) || nsConfig.isAllocated(cooldown.Port) || !now.Before(cooldown.Until) {
+			klog.V(2).Infof("skip restoring cooldown of port %d in namespace %s", cooldown.Port, cooldown.Namespace)
+			continue
+		}
+		nsConfig.cooldown[cooldown.Port] = cooldown
+		restored++
+	}
+
+	return restored
+}
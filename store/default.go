@@ -0,0 +1,60 @@
+package store
+
+import "fmt"
+
+// DefaultPolicy decides what happens to services in namespaces without a configured range
+type DefaultPolicy string
+
+const (
+	// DefaultAllow lets services through without managing their nodePorts
+	DefaultAllow DefaultPolicy = "allow"
+	// DefaultDeny denies services that would hold nodePorts
+	DefaultDeny DefaultPolicy = "deny"
+	// DefaultCatchAll allocates from a range shared by every such namespace
+	DefaultCatchAll DefaultPolicy = "catch-all"
+)
+
+// ParseDefaultPolicy converts a configured policy, the empty policy is allow
+func ParseDefaultPolicy(policy string) (DefaultPolicy, error) {
+	switch DefaultPolicy(policy) {
+	case "":
+		return DefaultAllow, nil
+	case DefaultAllow, DefaultDeny, DefaultCatchAll:
+		return DefaultPolicy(policy), nil
+	}
+	return "", fmt.Errorf("unknown default policy %q, MUST be allow, deny or catch-all", policy)
+}
+
+// SetCatchAll 设置catch-all端口池，没有被任何配置匹配的namespace在第一次出现时绑定到该端口池。
+// m.Pool只用于显示，m.Pattern和m.Selector被忽略
+func (c *NamespaceNodePortConfig) SetCatchAll(ranges PortRanges, m NamespaceMatcher) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if len(ranges) == 0 {
+		return fmt.Errorf("catch-all pool has no nodeport range")
+	}
+	if _, err := NewAllocator(m.Strategy); err != nil {
+		return err
+	}
+
+	pool := newPortPool(ranges)
+	c.pools = append(c.pools, pool)
+	m.Pattern, m.Selector = "", nil
+	c.fallback = &namespaceMatcher{NamespaceMatcher: m, pool: pool, reserved: make(map[int32]bool)}
+	for _, pr := range m.Reserved {
+		for port := pr.Min; port <= pr.Max; port++ {
+			c.fallback.reserved[port] = true
+		}
+	}
+	return nil
+}
+
+// InCatchAll reports whether namespace draws its ports from the catch-all pool
+func (c *NamespaceNodePortConfig) InCatchAll(namespace string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	return ok && c.fallback != nil && nsConfig.matcher == c.fallback
+}
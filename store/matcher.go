@@ -0,0 +1,193 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"sort"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/klog/v2"
+)
+
+// NamespaceMatcher binds every namespace matching Pattern and Selector to a shared pool.
+// When several matchers match a namespace the most specific one wins:
+//  1. a namespace configured by name never uses a matcher
+//  2. matchers with a glob come before matchers with only a selector
+//  3. among globs the one with more literal characters wins, a glob that also has a
+//     selector wins over the same glob without one, then the glob sorting first
+//  4. among selectors the one with more requirements wins, then the selector sorting first
+//  5. the catch-all pool of the default policy takes whatever is left
+//
+// A namespace is bound when it is first seen. It is rebound when its labels change as
+// long as it holds no ports, otherwise it keeps its pool until it released them.
+type NamespaceMatcher struct {
+	// Pattern is matched against the namespace name with path.Match, empty matches any name
+	Pattern string
+	// Selector is matched against the namespace labels, nil matches any labels
+	Selector labels.Selector
+	// Pool is the name of the shared pool, created by AddSharedPool
+	Pool     string
+	Reserved PortRanges
+	Strategy string
+	// 每个匹配的namespace的端口配额，0表示不限制
+	MaxPorts int
+	MinPorts int
+}
+
+type namespaceMatcher struct {
+	NamespaceMatcher
+	pool     *portPool
+	reserved map[int32]bool
+}
+
+// AddNamespaceMatcher 添加按glob或者label匹配namespace的规则，匹配的namespace使用Pool指定的共享端口池
+func (c *NamespaceNodePortConfig) AddNamespaceMatcher(m NamespaceMatcher) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if m.Pattern == "" && m.Selector == nil {
+		return fmt.Errorf("matcher of pool %s has neither pattern nor selector", m.Pool)
+	}
+	if _, err := path.Match(m.Pattern, ""); err != nil {
+		return fmt.Errorf("bad namespace pattern %s: %v", m.Pattern, err)
+	}
+	pool, ok := c.sharedPools[m.Pool]
+	if !ok {
+		return fmt.Errorf("pool %s does not exist", m.Pool)
+	}
+	if _, err := NewAllocator(m.Strategy); err != nil {
+		return err
+	}
+	if m.MaxPorts > 0 && m.MinPorts > m.MaxPorts {
+		return fmt.Errorf("guaranteed nodePorts %d of pool %s exceed its quota %d", m.MinPorts, m.Pool, m.MaxPorts)
+	}
+
+	matcher := &namespaceMatcher{NamespaceMatcher: m, pool: pool, reserved: make(map[int32]bool)}
+	for _, pr := range m.Reserved {
+		for port := pr.Min; port <= pr.Max; port++ {
+			matcher.reserved[port] = true
+		}
+	}
+	c.matchers = append(c.matchers, matcher)
+	sort.SliceStable(c.matchers, func(i, j int) bool {
+		return c.matchers[i].before(c.matchers[j])
+	})
+	return nil
+}
+
+// resolve binds namespace to the pool of the matcher it matches, keeping the binding of a
+// namespace that still holds ports
+func (c *NamespaceNodePortConfig) resolve(namespace string, bound *NamespaceConfig) (*NamespaceConfig, bool) {
+	m := c.match(namespace)
+	if bound != nil {
+		if bound.matcher == m {
+			return bound, true
+		}
+		if bound.nsUsage[namespace] > 0 {
+			klog.V(2).Infof("namespace %s no longer matches the pool %s but still holds ports, keep it", namespace, bound.Pool)
+			return bound, true
+		}
+		delete(bound.maxPorts, namespace)
+		delete(bound.minPorts, namespace)
+		delete(c.NamespaceConfigs, namespace)
+	}
+	if m == nil {
+		return &NamespaceConfig{}, false
+	}
+
+	allocator, _ := NewAllocator(m.Strategy)
+	nsConfig := &NamespaceConfig{
+		Pool:      m.Pool,
+		reserved:  m.reserved,
+		allocator: allocator,
+		matcher:   m,
+		portPool:  m.pool,
+	}
+	m.pool.maxPorts[namespace] = m.MaxPorts
+	m.pool.minPorts[namespace] = m.MinPorts
+	c.NamespaceConfigs[namespace] = nsConfig
+	klog.V(2).Infof("namespace %s is bound to pool %s", namespace, m.Pool)
+
+	return nsConfig, true
+}
+
+// match returns the matcher of highest precedence matching namespace, the catch-all pool
+// if there is one when nothing matches
+func (c *NamespaceNodePortConfig) match(namespace string) *namespaceMatcher {
+	var nsLabels labels.Set
+	fetched := false
+	for _, m := range c.matchers {
+		if m.Pattern != "" {
+			if ok, _ := path.Match(m.Pattern, namespace); !ok {
+				continue
+			}
+		}
+		if m.Selector != nil {
+			// namespace的label只在需要时获取
+			if !fetched && c.NamespaceLabels != nil {
+				if l, ok := c.NamespaceLabels(namespace); ok {
+					nsLabels = labels.Set(l)
+				}
+				fetched = true
+			}
+			if nsLabels == nil || !m.Selector.Matches(nsLabels) {
+				continue
+			}
+		}
+		return m
+	}
+	return c.fallback
+}
+
+// before orders matchers by precedence, see NamespaceMatcher
+func (m *namespaceMatcher) before(o *namespaceMatcher) bool {
+	if (m.Pattern != "") != (o.Pattern != "") {
+		return m.Pattern != ""
+	}
+	if m.Pattern != "" {
+		if ml, ol := literalLen(m.Pattern), literalLen(o.Pattern); ml != ol {
+			return ml > ol
+		}
+		if (m.Selector != nil) != (o.Selector != nil) {
+			return m.Selector != nil
+		}
+		if m.Pattern != o.Pattern {
+			return m.Pattern < o.Pattern
+		}
+	}
+	if m.Selector != nil && o.Selector != nil {
+		mr, _ := m.Selector.Requirements()
+		or, _ := o.Selector.Requirements()
+		if len(mr) != len(or) {
+			return len(mr) > len(or)
+		}
+		if ms, ol := m.Selector.String(), o.Selector.String(); ms != ol {
+			return ms < ol
+		}
+	}
+	return m.Pool < o.Pool
+}
+
+// literalLen counts the characters of a glob outside of wildcards and character classes
+func literalLen(pattern string) int {
+	n := 0
+	for i := 0; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '*', '?':
+		case '[':
+			// 字符类中转义的']'不结束字符类
+			for i < len(pattern) && pattern[i] != ']' {
+				if pattern[i] == '\\' {
+					i++
+				}
+				i++
+			}
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,182 @@
+package store
+
+import (
+	"testing"
+
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+func TestLiteralLen(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    int
+	}{
+		{pattern: "team-a", want: 6},
+		{pattern: "*", want: 0},
+		{pattern: "team-*", want: 5},
+		{pattern: "team-?", want: 5},
+		{pattern: "team-[ab]", want: 5},
+		{pattern: "team-[^a-c]x", want: 6},
+		{pattern: `team-\*`, want: 6},
+		{pattern: `esc\-*`, want: 4},
+		{pattern: `team-[\]x]*`, want: 5},
+	}
+
+	for _, tt := range tests {
+		if got := literalLen(tt.pattern); got != tt.want {
+			t.Errorf("literalLen(%q) = %d, want %d", tt.pattern, got, tt.want)
+		}
+	}
+}
+
+// poolOf returns the pool namespace is bound to
+func poolOf(c *NamespaceNodePortConfig, namespace string) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	return nsConfig.Pool, ok
+}
+
+func mustSelector(t *testing.T, selector string) labels.Selector {
+	t.Helper()
+	s, err := labels.Parse(selector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestMatcherPrecedence(t *testing.T) {
+	matchers := []NamespaceMatcher{
+		{Pattern: "team-*", Pool: "glob"},
+		{Pattern: "team-a*", Pool: "longer-glob"},
+		{Pattern: "team-*", Selector: mustSelector(t, "env=prod"), Pool: "glob-selector"},
+		{Pattern: "team-[xy]*", Pool: "class"},
+		{Pattern: "esc*", Pool: "short-glob"},
+		{Pattern: `esc\-*`, Pool: "escaped"},
+		{Selector: mustSelector(t, "env=prod"), Pool: "selector"},
+		{Selector: mustSelector(t, "env=prod,tier=web"), Pool: "longer-selector"},
+	}
+	tests := []struct {
+		namespace string
+		labels    map[string]string
+		want      string
+		wantOK    bool
+	}{
+		{namespace: "team-b", want: "glob", wantOK: true},
+		{namespace: "team-a1", want: "longer-glob", wantOK: true},
+		{namespace: "team-b", labels: map[string]string{"env": "prod"}, want: "glob-selector", wantOK: true},
+		// 字面字符更多的glob优先于同时带有selector的glob
+		{namespace: "team-a1", labels: map[string]string{"env": "prod"}, want: "longer-glob", wantOK: true},
+		// 字面字符相同时按glob排序，"team-*"排在"team-[xy]*"之前
+		{namespace: "team-x", want: "glob", wantOK: true},
+		{namespace: "esc-a", want: "escaped", wantOK: true},
+		{namespace: "escape", want: "short-glob", wantOK: true},
+		// glob优先于只有selector的规则
+		{namespace: "team-c", labels: map[string]string{"env": "prod", "tier": "web"}, want: "glob-selector", wantOK: true},
+		{namespace: "other", labels: map[string]string{"env": "prod"}, want: "selector", wantOK: true},
+		{namespace: "other", labels: map[string]string{"env": "prod", "tier": "web"}, want: "longer-selector", wantOK: true},
+		{namespace: "other", labels: map[string]string{"env": "dev"}},
+		{namespace: "other"},
+	}
+
+	// 规则的添加顺序不影响结果
+	orders := map[string][]NamespaceMatcher{"added in order": matchers}
+	reversed := make([]NamespaceMatcher, len(matchers))
+	for i, m := range matchers {
+		reversed[len(matchers)-1-i] = m
+	}
+	orders["added in reverse"] = reversed
+
+	for order, ms := range orders {
+		for _, tt := range tests {
+			c := NewNamespaceNodePortConfig()
+			for i, m := range ms {
+				port := int32(30000 + 10*i)
+				if err := c.AddSharedPool(m.Pool, PortRanges{{Min: port, Max: port + 9}}, nil); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.AddNamespaceMatcher(m); err != nil {
+					t.Fatal(err)
+				}
+			}
+			c.NamespaceLabels = func(string) (map[string]string, bool) {
+				return tt.labels, tt.labels != nil
+			}
+
+			got, ok := poolOf(c, tt.namespace)
+			if ok != tt.wantOK || got != tt.want {
+				t.Errorf("%s: namespace %s with labels %v is bound to %q, %t, want %q, %t",
+					order, tt.namespace, tt.labels, got, ok, tt.want, tt.wantOK)
+			}
+		}
+	}
+}
+
+func TestMatcherCatchAll(t *testing.T) {
+	c := NewNamespaceNodePortConfig()
+	if err := c.AddSharedPool("team", PortRanges{{Min: 30000, Max: 30009}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.AddNamespaceMatcher(NamespaceMatcher{Pattern: "team-*", Pool: "team"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetCatchAll(PortRanges{{Min: 32000, Max: 32009}}, NamespaceMatcher{Pool: "catch-all"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := poolOf(c, "team-a"); got != "team" {
+		t.Errorf("team-a is bound to %q, want team", got)
+	}
+	if got, ok := poolOf(c, "other"); !ok || got != "catch-all" || !c.InCatchAll("other") {
+		t.Errorf("other is bound to %q, %t, want the catch-all pool", got, ok)
+	}
+}
+
+func TestResolveRebind(t *testing.T) {
+	c := NewNamespaceNodePortConfig()
+	for i, pool := range []string{"prod", "dev"} {
+		port := int32(30000 + 10*i)
+		if err := c.AddSharedPool(pool, PortRanges{{Min: port, Max: port + 9}}, nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := c.AddNamespaceMatcher(NamespaceMatcher{Selector: mustSelector(t, "env="+pool), Pool: pool}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nsLabels := map[string]string{"env": "prod"}
+	c.NamespaceLabels = func(string) (map[string]string, bool) {
+		return nsLabels, true
+	}
+
+	expect := func(step, want string, wantOK bool) {
+		t.Helper()
+		if got, ok := poolOf(c, "ns"); got != want || ok != wantOK {
+			t.Fatalf("%s: ns is bound to %q, %t, want %q, %t", step, got, ok, want, wantOK)
+		}
+	}
+
+	expect("first seen", "prod", true)
+
+	nsLabels = map[string]string{"env": "dev"}
+	expect("labels changed without ports", "dev", true)
+
+	ports, err := c.AllocatePorts("ns", "ns/svc", []PortRequest{{Name: "http"}}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nsLabels = map[string]string{"env": "prod"}
+	expect("labels changed while holding ports", "dev", true)
+
+	nsLabels = map[string]string{}
+	expect("labels removed while holding ports", "dev", true)
+
+	if err := c.ReleasePorts("ns", "ns/svc", "", ports); err != nil {
+		t.Fatal(err)
+	}
+	expect("ports released", "", false)
+
+	nsLabels = map[string]string{"env": "prod"}
+	expect("labels added again", "prod", true)
+}
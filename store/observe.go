@@ -0,0 +1,105 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// PortKind tells how an observed port relates to the namespace of its service
+type PortKind string
+
+const (
+	// PortInRange is inside the range of the namespace of the service
+	PortInRange PortKind = "in-range"
+	// PortForeign is inside the range of another namespace
+	PortForeign PortKind = "foreign"
+	// PortUnmanaged is inside no configured range
+	PortUnmanaged PortKind = "unmanaged"
+)
+
+// locate returns the pool whose range holds port and how it relates to namespace, nil for
+// ports outside every range
+func (c *NamespaceNodePortConfig) locate(namespace string, port int32) (*portPool, PortKind) {
+	if nsConfig, ok := c.getNamespace(namespace); ok && nsConfig.inRange(port) {
+		return nsConfig.portPool, PortInRange
+	}
+	for _, pool := range c.pools {
+		if pool.inRange(port) {
+			return pool, PortForeign
+		}
+	}
+	return nil, PortUnmanaged
+}
+
+// observe 记录service实际使用的端口及其协议，不在namespace范围内的端口也记录为已占用，保证不会被再次分配
+func (c *NamespaceNodePortConfig) observe(namespace, owner, uid string, port int32, protocols []string) error {
+	pool, kind := c.locate(namespace, port)
+	if pool == nil {
+		if alloc, ok := c.unmanaged[port]; ok && alloc.Owner != owner {
+			return fmt.Errorf("unmanaged port %d of service %s is recorded as held by %s", port, owner, alloc.Owner)
+		}
+		alloc, ok := c.unmanaged[port]
+		if !ok {
+			alloc = &Allocation{Namespace: namespace, Port: port, Owner: owner, AllocatedAt: time.Now(), Kind: kind}
+			c.unmanaged[port] = alloc
+		}
+		alloc.UID = uid
+		alloc.setProtocols(protocols)
+		return nil
+	}
+
+	if pool.isAllocated(port) && pool.owner(port) != owner {
+		return fmt.Errorf("port %d of service %s is recorded as held by %s", port, owner, pool.owner(port))
+	}
+	alloc := pool.take(namespace, port, owner, uid, time.Time{})
+	alloc.Kind = kind
+	alloc.setProtocols(protocols)
+	return nil
+}
+
+// setProtocols records the protocols using the port, nil keeps what was recorded
+func (a *Allocation) setProtocols(protocols []string) {
+	if protocols == nil {
+		return
+	}
+	a.Protocols = append([]string(nil), protocols...)
+	sort.Strings(a.Protocols)
+}
+
+// holds reports whether owner holds port, whether or not the port is in the range of namespace
+func (c *NamespaceNodePortConfig) holds(namespace, owner string, port int32) bool {
+	pool, _ := c.locate(namespace, port)
+	if pool == nil {
+		alloc, ok := c.unmanaged[port]
+		return ok && alloc.Owner == owner
+	}
+	return pool.isAllocated(port) && pool.owner(port) == owner
+}
+
+// release 释放owner持有的端口，不论端口是否在namespace的范围内，记录的UID不是uid的端口保持不变
+func (c *NamespaceNodePortConfig) release(namespace, owner, uid string, port int32) {
+	pool, _ := c.locate(namespace, port)
+	if pool == nil {
+		if alloc, ok := c.unmanaged[port]; ok && alloc.Owner == owner && alloc.UID == uid {
+			delete(c.unmanaged, port)
+		}
+		return
+	}
+	alloc, ok := pool.Allocations[port]
+	if !ok || alloc.Owner != owner || alloc.UID != uid {
+		return
+	}
+	// 端口已经交给重建的同名service，转为等待其确认的预留
+	if time.Now().Before(alloc.handoverUntil) {
+		klog.V(2).Infof("port %d of %s is handed over to the recreated service", port, owner)
+		alloc.UID = ""
+		until := alloc.handoverUntil
+		alloc.ReservedUntil = &until
+		alloc.handoverUntil = time.Time{}
+		return
+	}
+	c.releasePort(pool, port)
+}
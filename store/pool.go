@@ -0,0 +1,226 @@
+package store
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// portPool owns the bitmaps and allocations of a set of port ranges. A namespace with its
+// own range has a private pool, the namespaces of a group share the pool of the group.
+type portPool struct {
+	NodePortRanges PortRanges
+	// 每个端口段对应一个已分配端口的位图
+	allocated []*portBitmap
+	// 已分配端口的详细记录
+	Allocations map[int32]*Allocation
+	// 每个namespace在池中已使用的端口数量
+	nsUsage map[string]int
+	// 每个namespace的配额，0表示不限制或者不保证
+	maxPorts map[string]int
+	minPorts map[string]int
+	// 释放后仍在冷却中的端口
+	cooldown map[int32]Cooldown
+	// 端口最近一次被释放的时间
+	releasedAt map[int32]time.Time
+}
+
+func newPortPool(ranges PortRanges) *portPool {
+	// 按端口排序各个端口段
+	ranges = append(PortRanges(nil), ranges...)
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].Min < ranges[j].Min
+	})
+
+	pool := &portPool{
+		NodePortRanges: ranges,
+		Allocations:    make(map[int32]*Allocation),
+		nsUsage:        make(map[string]int),
+		maxPorts:       make(map[string]int),
+		minPorts:       make(map[string]int),
+		cooldown:       make(map[int32]Cooldown),
+		releasedAt:     make(map[int32]time.Time),
+	}
+	for _, pr := range ranges {
+		pool.allocated = append(pool.allocated, newPortBitmap(pr))
+	}
+	return pool
+}
+
+// segment returns the bitmap of the segment port belongs to
+func (p *portPool) segment(port int32) *portBitmap {
+	for _, b := range p.allocated {
+		if b.contains(port) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (p *portPool) inRange(port int32) bool {
+	return p.segment(port) != nil
+}
+
+func (p *portPool) isAllocated(port int32) bool {
+	b := p.segment(port)
+	return b != nil && b.isSet(port)
+}
+
+// Ranges returns the sorted segments of the pool
+func (p *portPool) Ranges() PortRanges {
+	return p.NodePortRanges
+}
+
+// NextFree 从from开始依次在各个端口段中查找空闲端口，到达末尾后从第一个端口段回绕一次
+func (p *portPool) NextFree(from int32, skip func(int32) bool) (int32, bool) {
+	n := len(p.allocated)
+	if n == 0 {
+		return 0, false
+	}
+
+	// from之后的第一个端口段，from超出所有端口段时从头开始
+	first, offset := 0, int32(0)
+	for i, b := range p.allocated {
+		if from < b.base+b.size {
+			first = i
+			if from > b.base {
+				offset = from - b.base
+			}
+			break
+		}
+	}
+
+	for i := 0; i <= n; i++ {
+		b := p.allocated[(first+i)%n]
+		start, end := int32(0), b.size
+		if i == 0 {
+			start = offset
+		} else if i == n {
+			end = offset
+		}
+		if port, ok := b.nextFree(start, end, skip); ok {
+			return port, true
+		}
+	}
+	return 0, false
+}
+
+// ReleasedAt returns when port was released last, zero if it never was
+func (p *portPool) ReleasedAt(port int32) time.Time {
+	return p.releasedAt[port]
+}
+
+// coolingDown reports whether port was released recently and must not be handed out yet
+func (p *portPool) coolingDown(port int32, now time.Time) bool {
+	cooldown, ok := p.cooldown[port]
+	return ok && now.Before(cooldown.Until)
+}
+
+func (p *portPool) used() int {
+	used := 0
+	for _, b := range p.allocated {
+		used += b.used()
+	}
+	return used
+}
+
+func (p *portPool) size() int {
+	size := 0
+	for _, b := range p.allocated {
+		size += int(b.size)
+	}
+	return size
+}
+
+// take 将端口分配给owner，reserveUntil不为零时端口需要在此之前被informer确认
+func (p *portPool) take(namespace string, port int32, owner, uid string, reserveUntil time.Time) *Allocation {
+	if b := p.segment(port); b != nil {
+		b.set(port)
+	}
+	alloc, ok := p.Allocations[port]
+	if !ok || alloc.Owner != owner {
+		alloc = &Allocation{Namespace: namespace, Port: port, Owner: owner, AllocatedAt: time.Now(), Kind: PortInRange}
+		p.record(alloc)
+	}
+	if uid != "" {
+		alloc.UID = uid
+		alloc.handoverUntil = time.Time{}
+	}
+	alloc.ReservedUntil = nil
+	if !reserveUntil.IsZero() {
+		alloc.ReservedUntil = &reserveUntil
+	}
+	return alloc
+}
+
+// owner returns the owner of port, empty if port is free
+func (p *portPool) owner(port int32) string {
+	if alloc, ok := p.Allocations[port]; ok {
+		return alloc.Owner
+	}
+	return ""
+}
+
+// record stores alloc, replacing whatever allocation held its port before
+func (p *portPool) record(alloc *Allocation) {
+	if old, ok := p.Allocations[alloc.Port]; ok {
+		p.nsUsage[old.Namespace]--
+	}
+	if b := p.segment(alloc.Port); b != nil {
+		b.set(alloc.Port)
+	}
+	// 显式使用冷却中的端口时结束冷却
+	delete(p.cooldown, alloc.Port)
+	p.Allocations[alloc.Port] = alloc
+	p.nsUsage[alloc.Namespace]++
+}
+
+func (p *portPool) release(port int32) {
+	if _, ok := p.Allocations[port]; ok {
+		p.releasedAt[port] = time.Now()
+	}
+	p.untake(port)
+}
+
+// untake frees port without recording a release, used to roll back a take
+func (p *portPool) untake(port int32) {
+	if b := p.segment(port); b != nil {
+		b.clear(port)
+	}
+	if old, ok := p.Allocations[port]; ok {
+		p.nsUsage[old.Namespace]--
+		delete(p.Allocations, port)
+	}
+}
+
+// checkQuota 检查namespace再使用n个端口是否超出配额，或者占用了保证给其他namespace的端口
+func (p *portPool) checkQuota(namespace string, n int) error {
+	used := p.nsUsage[namespace]
+	if max := p.maxPorts[namespace]; max > 0 && used+n > max {
+		return &QuotaExceededError{Namespace: namespace, Used: used, Requested: n, Max: max}
+	}
+
+	guaranteed := 0
+	for ns, min := range p.minPorts {
+		if ns != namespace && p.nsUsage[ns] < min {
+			guaranteed += min - p.nsUsage[ns]
+		}
+	}
+	if free := p.size() - p.used(); guaranteed > 0 && free-n < guaranteed {
+		return fmt.Errorf("namespace %s cannot take %d more nodePorts, %d of the %d free ports are guaranteed to other namespaces", namespace, n, guaranteed, free)
+	}
+
+	return nil
+}
+
+// QuotaExceededError is returned when a namespace asks for more ports than its quota allows
+type QuotaExceededError struct {
+	Namespace string
+	Used      int
+	Requested int
+	Max       int
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf("namespace %s uses %d of its %d nodePort quota, cannot take %d more", e.Namespace, e.Used, e.Max, e.Requested)
+}
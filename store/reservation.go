@@ -0,0 +1,45 @@
+package store
+
+import (
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// DefaultReservationTTL is how long a port handed out by the webhook stays reserved
+// before the service shows up in the informer
+const DefaultReservationTTL = 2 * time.Minute
+
+// ConfirmPorts 在informer观察到service后确认其端口及协议，未被记录的端口直接标记为已占用，不在namespace范围内的端口也会记录
+func (c *NamespaceNodePortConfig) ConfirmPorts(namespace, owner, uid string, ports []int32, protocols map[int32][]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	for _, port := range ports {
+		if err := c.observe(namespace, owner, uid, port, protocols[port]); err != nil {
+			klog.Warning(err)
+		}
+	}
+
+	return nil
+}
+
+// ExpireReservations 释放所有在now之前过期且未被确认的端口，返回释放的端口数量
+func (c *NamespaceNodePortConfig) ExpireReservations(now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expired := 0
+	for _, pool := range c.pools {
+		for port, alloc := range pool.Allocations {
+			if !alloc.Reserved() || now.Before(*alloc.ReservedUntil) {
+				continue
+			}
+			klog.V(2).Infof("reservation of port %d in namespace %s by %s expired", port, alloc.Namespace, alloc.Owner)
+			pool.release(port)
+			expired++
+		}
+	}
+
+	return expired
+}
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"sort"
+
+	"k8s.io/klog/v2"
+)
+
+// Snapshot returns a copy of every allocation, sorted by namespace and port
+func (c *NamespaceNodePortConfig) Snapshot() []Allocation {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var allocations []Allocation
+	for _, pool := range c.pools {
+		for _, alloc := range pool.Allocations {
+			allocations = append(allocations, *alloc)
+		}
+	}
+	for _, alloc := range c.unmanaged {
+		allocations = append(allocations, *alloc)
+	}
+
+	sort.Slice(allocations, func(i, j int) bool {
+		if allocations[i].Namespace != allocations[j].Namespace {
+			return allocations[i].Namespace < allocations[j].Namespace
+		}
+		return allocations[i].Port < allocations[j].Port
+	})
+
+	return allocations
+}
+
+// Restore 从持久化的分配表中恢复已分配端口，配置变化后端口的类型按当前的范围重新计算
+func (c *NamespaceNodePortConfig) Restore(allocations []Allocation) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	restored := 0
+	for i := range allocations {
+		alloc := allocations[i]
+		pool, kind := c.locate(alloc.Namespace, alloc.Port)
+		alloc.Kind = kind
+		if pool == nil {
+			// 不在任何范围内的端口没有预留，只记录已确认的端口
+			if alloc.Reserved() {
+				klog.V(2).Infof("skip restoring reserved port %d of %s, it is in no range", alloc.Port, alloc.Owner)
+				continue
+			}
+			c.unmanaged[alloc.Port] = &alloc
+		} else {
+			pool.record(&alloc)
+		}
+		restored++
+	}
+
+	return restored
+}
+
+// LiveService is a service the informer listed and the nodePorts it currently uses, a service
+// that no longer consumes nodePorts has none
+type LiveService struct {
+	UID   string
+	Ports []int32
+}
+
+// ReleaseStale 释放所有owner已不存在的已确认端口，以及仍存在的service已不再使用的端口。
+// live为当前存在的service
+func (c *NamespaceNodePortConfig) ReleaseStale(live map[string]LiveService) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	released := 0
+	for _, pool := range c.pools {
+		for port, alloc := range pool.Allocations {
+			if alloc.Reserved() || !stale(alloc, live) {
+				continue
+			}
+			klog.V(2).Infof("release port %d of %s, the service no longer uses it", port, alloc.Owner)
+			c.releasePort(pool, port)
+			released++
+		}
+	}
+	for port, alloc := range c.unmanaged {
+		if !stale(alloc, live) {
+			continue
+		}
+		klog.V(2).Infof("release port %d of %s, the service no longer uses it", port, alloc.Owner)
+		delete(c.unmanaged, port)
+		released++
+	}
+
+	return released
+}
+
+// stale tells whether the confirmed alloc belongs to no live service or to a port its service
+// no longer uses
+func stale(alloc *Allocation, live map[string]LiveService) bool {
+	service, ok := live[alloc.Owner]
+	if !ok || (alloc.UID != "" && alloc.UID != service.UID) {
+		return true
+	}
+	for _, port := range service.Ports {
+		if port == alloc.Port {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,59 @@
+package store
+
+import "testing"
+
+func TestReleaseStale(t *testing.T) {
+	tests := []struct {
+		name string
+		live map[string]LiveService
+		// wantHeld is every port left after the reconcile
+		wantHeld []int32
+	}{
+		{
+			name:     "service still uses its ports",
+			live:     map[string]LiveService{"ns/a": {UID: "u1", Ports: []int32{30001, 31000}}},
+			wantHeld: []int32{30001, 31000},
+		},
+		{
+			name: "service was deleted",
+			live: map[string]LiveService{},
+		},
+		{
+			name: "service was recreated",
+			live: map[string]LiveService{"ns/a": {UID: "u2", Ports: []int32{30001, 31000}}},
+		},
+		{
+			name:     "service dropped a port",
+			live:     map[string]LiveService{"ns/a": {UID: "u1", Ports: []int32{31000}}},
+			wantHeld: []int32{31000},
+		},
+		{
+			name: "service became ClusterIP",
+			live: map[string]LiveService{"ns/a": {UID: "u1"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewNamespaceNodePortConfig()
+			if err := c.AddNamespace("ns", PortRanges{{Min: 30000, Max: 30009}}); err != nil {
+				t.Fatal(err)
+			}
+			c.Restore([]Allocation{
+				{Namespace: "ns", Owner: "ns/a", UID: "u1", Port: 30001},
+				{Namespace: "ns", Owner: "ns/a", UID: "u1", Port: 31000},
+			})
+
+			c.ReleaseStale(tt.live)
+			held := heldPorts(c)
+			if len(held) != len(tt.wantHeld) {
+				t.Fatalf("held ports %v, want %v", held, tt.wantHeld)
+			}
+			for _, port := range tt.wantHeld {
+				if _, ok := held[port]; !ok {
+					t.Errorf("port %d was released", port)
+				}
+			}
+		})
+	}
+}
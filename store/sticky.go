@@ -0,0 +1,141 @@
+package store
+
+import (
+	"sort"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// StickyPort remembers the nodePort a ServicePort had, so that a recreated service with
+// the same namespace, name and port name gets it back
+type StickyPort struct {
+	Namespace string `json:"namespace"`
+	// Owner 为service的namespace/name
+	Owner    string `json:"owner"`
+	PortName string `json:"portName"`
+	Port     int32  `json:"port"`
+	// ReleasedAt is zero while the service still holds the port
+	ReleasedAt time.Time `json:"releasedAt,omitempty"`
+}
+
+// RememberPorts 记录owner每个端口名称当前使用的nodePort，StickyRetention为0时不记录
+func (c *NamespaceNodePortConfig) RememberPorts(namespace, owner string, named map[string]int32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.StickyRetention <= 0 || len(named) == 0 {
+		return
+	}
+
+	ports, ok := c.sticky[owner]
+	if !ok {
+		ports = make(map[string]*StickyPort)
+		c.sticky[owner] = ports
+	}
+	for name, port := range named {
+		ports[name] = &StickyPort{Namespace: namespace, Owner: owner, PortName: name, Port: port}
+	}
+}
+
+// stickyPort 返回owner的端口名称在保留时间内释放的nodePort，或者删除事件处理之前仍由owner持有的nodePort，
+// 端口被其他service占用、保留或者不在范围内时返回false
+func (c *NamespaceNodePortConfig) stickyPort(nsConfig *NamespaceConfig, owner, portName string) (int32, bool) {
+	sticky, ok := c.sticky[owner][portName]
+	if !ok || !nsConfig.inRange(sticky.Port) || c.isReserved(nsConfig, sticky.Port) {
+		return 0, false
+	}
+	held := nsConfig.isAllocated(sticky.Port)
+	if held && nsConfig.owner(sticky.Port) != owner {
+		return 0, false
+	}
+
+	// 删除事件还没有被处理时端口仍记录在同名service下
+	if sticky.ReleasedAt.IsZero() {
+		return sticky.Port, held
+	}
+	if time.Since(sticky.ReleasedAt) > c.StickyRetention {
+		return 0, false
+	}
+
+	return sticky.Port, true
+}
+
+// stickyReleased starts the retention window of the sticky ports of owner using port
+func (c *NamespaceNodePortConfig) stickyReleased(owner string, port int32, now time.Time) {
+	for _, sticky := range c.sticky[owner] {
+		if sticky.Port == port && sticky.ReleasedAt.IsZero() {
+			sticky.ReleasedAt = now
+		}
+	}
+}
+
+// ExpireStickyPorts 清理保留时间已过的记录，返回清理的数量
+func (c *NamespaceNodePortConfig) ExpireStickyPorts(now time.Time) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	expired := 0
+	for owner, ports := range c.sticky {
+		for name, sticky := range ports {
+			if sticky.ReleasedAt.IsZero() || now.Sub(sticky.ReleasedAt) <= c.StickyRetention {
+				continue
+			}
+			delete(ports, name)
+			expired++
+		}
+		if len(ports) == 0 {
+			delete(c.sticky, owner)
+		}
+	}
+
+	return expired
+}
+
+// StickyPorts returns a copy of the sticky ports whose service is gone, sorted by owner and
+// port name. Ports still held are remembered again once the informer observes their service.
+func (c *NamespaceNodePortConfig) StickyPorts() []StickyPort {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var stickyPorts []StickyPort
+	for _, ports := range c.sticky {
+		for _, sticky := range ports {
+			if !sticky.ReleasedAt.IsZero() {
+				stickyPorts = append(stickyPorts, *sticky)
+			}
+		}
+	}
+
+	sort.Slice(stickyPorts, func(i, j int) bool {
+		if stickyPorts[i].Owner != stickyPorts[j].Owner {
+			return stickyPorts[i].Owner < stickyPorts[j].Owner
+		}
+		return stickyPorts[i].PortName < stickyPorts[j].PortName
+	})
+
+	return stickyPorts
+}
+
+// RestoreStickyPorts 恢复持久化的记录，保留时间已过的记录被忽略
+func (c *NamespaceNodePortConfig) RestoreStickyPorts(stickyPorts []StickyPort) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	now := time.Now()
+	restored := 0
+	for i := range stickyPorts {
+		sticky := stickyPorts[i]
+		if sticky.ReleasedAt.IsZero() || now.Sub(sticky.ReleasedAt) > c.StickyRetention {
+			klog.V(2).Infof("skip restoring sticky port %d of %s, the retention expired", sticky.Port, sticky.Owner)
+			continue
+		}
+		if _, ok := c.sticky[sticky.Owner]; !ok {
+			c.sticky[sticky.Owner] = make(map[string]*StickyPort)
+		}
+		c.sticky[sticky.Owner][sticky.PortName] = &sticky
+		restored++
+	}
+
+	return restored
+}
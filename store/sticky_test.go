@@ -0,0 +1,98 @@
+package store
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStickyHandover(t *testing.T) {
+	tests := []struct {
+		name string
+		// steps run after ns/a with uid u1 confirmed 30000 for port http and the webhook
+		// admitted a service ns/a asking for port http again
+		steps     func(t *testing.T, c *NamespaceNodePortConfig)
+		wantOwner bool
+		wantUID   string
+		// wantReserved tells whether the port waits for the new service to confirm it
+		wantReserved bool
+	}{
+		{
+			name:      "duplicate create of a live service keeps the confirmed port",
+			steps:     func(t *testing.T, c *NamespaceNodePortConfig) {},
+			wantOwner: true, wantUID: "u1",
+		},
+		{
+			name: "duplicate create survives the reservation expiry",
+			steps: func(t *testing.T, c *NamespaceNodePortConfig) {
+				c.ExpireReservations(time.Now().Add(time.Hour))
+			},
+			wantOwner: true, wantUID: "u1",
+		},
+		{
+			name: "late delete of the old service hands the port over",
+			steps: func(t *testing.T, c *NamespaceNodePortConfig) {
+				mustRelease(t, c, "u1", 30000)
+			},
+			wantOwner: true, wantReserved: true,
+		},
+		{
+			name: "new service confirms the handed over port",
+			steps: func(t *testing.T, c *NamespaceNodePortConfig) {
+				mustRelease(t, c, "u1", 30000)
+				if err := c.ConfirmPorts("ns", "ns/a", "u2", []int32{30000}, nil); err != nil {
+					t.Fatal(err)
+				}
+				mustRelease(t, c, "u1", 30000)
+			},
+			wantOwner: true, wantUID: "u2",
+		},
+		{
+			name: "handover never confirmed expires",
+			steps: func(t *testing.T, c *NamespaceNodePortConfig) {
+				mustRelease(t, c, "u1", 30000)
+				c.ExpireReservations(time.Now().Add(time.Hour))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewNamespaceNodePortConfig()
+			c.StickyRetention = time.Hour
+			if err := c.AddNamespace("ns", PortRanges{{Min: 30000, Max: 30009}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.ConfirmPorts("ns", "ns/a", "u1", []int32{30000}, nil); err != nil {
+				t.Fatal(err)
+			}
+			c.RememberPorts("ns", "ns/a", map[string]int32{"http": 30000})
+
+			ports, err := c.AllocatePorts("ns", "ns/a", []PortRequest{{Name: "http"}}, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ports[0] != 30000 {
+				t.Fatalf("recreated service got %d, want 30000", ports[0])
+			}
+
+			tt.steps(t, c)
+			alloc, ok := c.NamespaceConfigs["ns"].Allocations[30000]
+			if ok != tt.wantOwner {
+				t.Fatalf("port 30000 held: %t, want %t", ok, tt.wantOwner)
+			}
+			if !ok {
+				return
+			}
+			if alloc.UID != tt.wantUID || alloc.Reserved() != tt.wantReserved {
+				t.Errorf("port 30000 has UID %q, reserved %t, want %q, %t", alloc.UID, alloc.Reserved(), tt.wantUID, tt.wantReserved)
+			}
+		})
+	}
+}
+
+func mustRelease(t *testing.T, c *NamespaceNodePortConfig, uid string, ports ...int32) {
+	t.Helper()
+	if err := c.ReleasePorts("ns", "ns/a", uid, ports); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,19 +1,80 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 )
 
 type NamespaceNodePortConfig struct {
 	NamespaceConfigs map[string]*NamespaceConfig
-	lock             sync.Mutex
+	// 所有端口池，共享池只出现一次
+	pools []*portPool
+	// webhook分配的端口在被informer确认之前保留的时间
+	ReservationTTL time.Duration
+	// 释放的端口在冷却时间内不会被自动分配，0表示立即可用
+	ReleaseCooldown time.Duration
+	// 被删除的service的端口在保留时间内优先分配给同名的service，0表示不保留
+	StickyRetention time.Duration
+	// 每个service按端口名称记录的端口
+	sticky map[string]map[string]*StickyPort
+	// 按名称索引的共享端口池
+	sharedPools map[string]*portPool
+	// 按glob或者label匹配namespace的规则，按优先级排序
+	matchers []*namespaceMatcher
+	// 没有被任何规则匹配的namespace使用的catch-all端口池
+	fallback *namespaceMatcher
+	// DefaultPolicy applies to namespaces matched by nothing
+	DefaultPolicy DefaultPolicy
+	// NamespaceLabels returns the labels of a namespace, used by matchers with a selector
+	NamespaceLabels func(namespace string) (map[string]string, bool)
+	// 全局保留端口，不会分配给任何namespace
+	reserved map[int32]bool
+	// 不在任何范围内但被service使用的端口
+	unmanaged map[int32]*Allocation
+	lock      sync.Mutex
 }
 
 type NamespaceConfig struct {
-	NodePortRange  PortRange
-	AllocatedPorts map[int32]bool
+	// Pool 为共享端口池的名称，使用独占范围的namespace为空
+	Pool string
+	// 该namespace的保留端口
+	reserved map[int32]bool
+	// 从端口池中选择端口的策略
+	allocator Allocator
+	// 通过glob或者label匹配的namespace的规则，按名称配置的namespace为nil
+	matcher *namespaceMatcher
+	*portPool
+}
+
+// Allocation records a port held by a service
+type Allocation struct {
+	Namespace string `json:"namespace"`
+	Port      int32  `json:"port"`
+	// Owner 为service的namespace/name
+	Owner string `json:"owner"`
+	// UID of the owning service, empty until the service is observed
+	UID         string    `json:"uid,omitempty"`
+	AllocatedAt time.Time `json:"allocatedAt"`
+	// ReservedUntil is set while the port waits for the informer to confirm it, a pointer so
+	// that confirmed allocations leave it out of the persisted table
+	ReservedUntil *time.Time `json:"reservedUntil,omitempty"`
+	// Kind tells whether the port lies in the range of its namespace, empty means in-range
+	Kind PortKind `json:"kind,omitempty"`
+	// Protocols using the port, a TCP/UDP pair of one service shares its nodePort
+	Protocols []string `json:"protocols,omitempty"`
+	// handoverUntil is set when a recreated service of the same name was handed the port,
+	// releasing it before then turns it into a reservation for the new service
+	handoverUntil time.Time
+}
+
+// Reserved reports whether the allocation still waits for confirmation
+func (a *Allocation) Reserved() bool {
+	return a.ReservedUntil != nil
 }
 
 type PortRange struct {
@@ -21,119 +82,310 @@ type PortRange struct {
 	Max int32
 }
 
+// PortRanges is a list of disjoint segments
+type PortRanges []PortRange
+
+func (r PortRange) String() string {
+	if r.Min == r.Max {
+		return strconv.Itoa(int(r.Min))
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+func (r PortRanges) String() string {
+	segments := make([]string, 0, len(r))
+	for _, pr := range r {
+		segments = append(segments, pr.String())
+	}
+	return strings.Join(segments, ",")
+}
+
 func NewNamespaceNodePortConfig() *NamespaceNodePortConfig {
 	return &NamespaceNodePortConfig{
 		NamespaceConfigs: make(map[string]*NamespaceConfig),
+		ReservationTTL:   DefaultReservationTTL,
+		DefaultPolicy:    DefaultAllow,
+		reserved:         make(map[int32]bool),
+		unmanaged:        make(map[int32]*Allocation),
+		sticky:           make(map[string]map[string]*StickyPort),
+		sharedPools:      make(map[string]*portPool),
 	}
 }
 
+// OwnerKey returns the key used to record which service holds a port
+func OwnerKey(namespace, name string) string {
+	return namespace + "/" + name
+}
+
 func (c *NamespaceNodePortConfig) getNamespace(namespace string) (*NamespaceConfig, bool) {
 	nsConfig, ok := c.NamespaceConfigs[namespace]
-	if !ok {
+	if ok && nsConfig.matcher == nil {
+		return nsConfig, true
+	}
+	if len(c.matchers) == 0 && c.fallback == nil {
 		return &NamespaceConfig{}, false
 	}
 
-	return nsConfig, true
+	return c.resolve(namespace, nsConfig)
 }
 
-func (c *NamespaceNodePortConfig) AddNamespace(namespace string, minPort, maxPort int32) error {
+func (c *NamespaceNodePortConfig) AddNamespace(namespace string, ranges PortRanges) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
 	// 检查命名空间是否已存在
-	if _, ok := c.getNamespace(namespace); ok {
+	if _, ok := c.NamespaceConfigs[namespace]; ok {
 		return fmt.Errorf("namespace %s already exists", namespace)
 	}
 
-	// 添加命名空间配置
-	c.NamespaceConfigs[namespace] = &NamespaceConfig{
-		NodePortRange:  PortRange{Min: minPort, Max: maxPort},
-		AllocatedPorts: make(map[int32]bool),
+	if len(ranges) == 0 {
+		return fmt.Errorf("namespace %s has no nodeport range", namespace)
 	}
+
+	// 添加命名空间配置
+	pool := newPortPool(ranges)
+	c.pools = append(c.pools, pool)
+	c.NamespaceConfigs[namespace] = &NamespaceConfig{allocator: &roundRobin{}, portPool: pool}
 	return nil
 }
 
-func (c *NamespaceNodePortConfig) AddPortToNamespace(namespace string, ports []int32) error {
+// AddSharedPool 添加组内共享的端口池，namespaces从同一个端口池中分配端口，AddNamespaceMatcher匹配的namespace也可以使用该端口池
+func (c *NamespaceNodePortConfig) AddSharedPool(name string, ranges PortRanges, namespaces []string) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// 检查命名空间是否存在
-	nsConfig, ok := c.getNamespace(namespace)
-	if !ok {
-		return fmt.Errorf("namespace %s does not exist", namespace)
+	if len(ranges) == 0 {
+		return fmt.Errorf("pool %s has no nodeport range", name)
+	}
+	if _, ok := c.sharedPools[name]; ok {
+		return fmt.Errorf("pool %s already exists", name)
 	}
+	for _, namespace := range namespaces {
+		if _, ok := c.NamespaceConfigs[namespace]; ok {
+			return fmt.Errorf("namespace %s already exists", namespace)
+		}
+	}
+
+	pool := newPortPool(ranges)
+	c.pools = append(c.pools, pool)
+	c.sharedPools[name] = pool
+	for _, namespace := range namespaces {
+		c.NamespaceConfigs[namespace] = &NamespaceConfig{Pool: name, allocator: &roundRobin{}, portPool: pool}
+	}
+	return nil
+}
+
+// AddPortToNamespace 记录service已使用的端口，不在namespace范围内的端口记录为foreign或者unmanaged，
+// 冲突的端口不影响其余端口的记录。protocols为每个端口使用的协议，可以为nil
+func (c *NamespaceNodePortConfig) AddPortToNamespace(namespace, owner, uid string, ports []int32, protocols map[int32][]string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
 	// 对切片进行排序
 	sort.Slice(ports, func(i, j int) bool {
 		return ports[i] < ports[j]
 	})
 
-	// 遍历要添加的端口，如果未分配则添加到列表中
+	var errs []error
 	for _, port := range ports {
-		// 检查是否超出范围
-		if port < nsConfig.NodePortRange.Min || port > nsConfig.NodePortRange.Max {
-			return fmt.Errorf("port %d is out of range for namespace %s", port, namespace)
+		if err := c.observe(namespace, owner, uid, port, protocols[port]); err != nil {
+			errs = append(errs, err)
 		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ReleasePorts 释放UID为uid的owner持有的端口。同名service被重建后记录的UID不同，被其他service持有、
+// 未被确认或者已经交给重建的service的端口保持不变
+func (c *NamespaceNodePortConfig) ReleasePorts(namespace, owner, uid string, ports []int32) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 
-		// 检查是否已经分配
-		if _, exists := nsConfig.AllocatedPorts[port]; exists {
-			return fmt.Errorf("port %d is already allocated in namespace %s", port, namespace)
+	for _, port := range ports {
+		c.release(namespace, owner, uid, port)
+	}
+
+	return nil
+}
+
+// markAllocated reserves port for owner, it reports whether the port was taken now or
+// owner already held it. The quota is checked by the caller.
+func (c *NamespaceNodePortConfig) markAllocated(nsConfig *NamespaceConfig, namespace, owner string, port int32, now time.Time) (bool, error) {
+	if !nsConfig.inRange(port) {
+		return false, fmt.Errorf("port %d is out of range for namespace %s", port, namespace)
+	}
+
+	if nsConfig.isAllocated(port) {
+		if nsConfig.owner(port) != owner {
+			return false, fmt.Errorf("port %d is already allocated to %s", port, nsConfig.owner(port))
+		}
+		return false, nil
+	}
+
+	// 已经在使用保留端口的service仍然可以更新，只拒绝新使用的保留端口
+	if c.isReserved(nsConfig, port) {
+		return false, fmt.Errorf("port %d is reserved for namespace %s", port, namespace)
+	}
+
+	nsConfig.take(namespace, port, owner, "", now.Add(c.ReservationTTL))
+	return true, nil
+}
+
+// SetReserved 设置保留端口，namespace为空时为全局保留端口
+func (c *NamespaceNodePortConfig) SetReserved(namespace string, ports PortRanges) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	reserved := make(map[int32]bool)
+	for _, pr := range ports {
+		for port := pr.Min; port <= pr.Max; port++ {
+			reserved[port] = true
 		}
+	}
 
-		// 添加到已分配列表，并将端口添加到 OrderedKeys 中
-		nsConfig.AllocatedPorts[port] = true
+	if namespace == "" {
+		c.reserved = reserved
+		return nil
 	}
 
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok {
+		return fmt.Errorf("namespace %s does not exist", namespace)
+	}
+	nsConfig.reserved = reserved
 	return nil
 }
 
-func (c *NamespaceNodePortConfig) RemovePortFromAPI(namespace string, ports []int32) error {
+// IsReserved reports whether port must not be used in namespace
+func (c *NamespaceNodePortConfig) IsReserved(namespace string, port int32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.reserved[port] {
+		return true
+	}
+	nsConfig, ok := c.getNamespace(namespace)
+	return ok && c.isReserved(nsConfig, port)
+}
+
+func (c *NamespaceNodePortConfig) isReserved(nsConfig *NamespaceConfig, port int32) bool {
+	return c.reserved[port] || nsConfig.reserved[port]
+}
+
+// SetAllocator 设置namespace选择端口的策略，共享端口池中的namespace可以使用不同的策略
+func (c *NamespaceNodePortConfig) SetAllocator(namespace string, allocator Allocator) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// 检查命名空间是否存在
 	nsConfig, ok := c.getNamespace(namespace)
 	if !ok {
 		return fmt.Errorf("namespace %s does not exist", namespace)
 	}
+	nsConfig.allocator = allocator
+	return nil
+}
 
-	// 遍历要移除的端口，如果已分配则从列表中移除
-	for _, port := range ports {
-		nsConfig.AllocatedPorts[port] = false
+// SetQuota 设置namespace最多可使用的端口数量max以及保证可用的端口数量min，0表示不限制
+func (c *NamespaceNodePortConfig) SetQuota(namespace string, min, max int) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok {
+		return fmt.Errorf("namespace %s does not exist", namespace)
+	}
+	if max > 0 && min > max {
+		return fmt.Errorf("guaranteed nodePorts %d of namespace %s exceed its quota %d", min, namespace, max)
 	}
 
+	nsConfig.maxPorts[namespace] = max
+	nsConfig.minPorts[namespace] = min
 	return nil
 }
 
-func (c *NamespaceNodePortConfig) FindAvailablePort(namespace string) (int32, error) {
+// CheckQuota 检查owner使用ports是否超出namespace的配额，owner已经持有的端口不重复计算
+func (c *NamespaceNodePortConfig) CheckQuota(namespace, owner string, ports []int32) error {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// 检查命名空间是否存在
 	nsConfig, ok := c.getNamespace(namespace)
 	if !ok {
-		return -1, fmt.Errorf("namespace %s does not exist", namespace)
+		return nil
 	}
 
-	// 遍历 NodePort 范围内的端口，找到第一个未分配的端口并返回
-	for port := nsConfig.NodePortRange.Min; port <= nsConfig.NodePortRange.Max; port++ {
-		if !nsConfig.AllocatedPorts[port] {
-			return port, nil
+	pending := 0
+	for _, port := range ports {
+		if nsConfig.inRange(port) && nsConfig.owner(port) != owner {
+			pending++
 		}
 	}
+	if pending == 0 {
+		return nil
+	}
 
-	// 如果未找到可用端口，则返回错误
-	return -1, fmt.Errorf("no available port in namespace %s", namespace)
+	return nsConfig.checkQuota(namespace, pending)
+}
+
+// PortOwner returns the service holding port in namespace, if any
+func (c *NamespaceNodePortConfig) PortOwner(namespace string, port int32) (string, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok || !nsConfig.isAllocated(port) {
+		return "", false
+	}
+
+	return nsConfig.owner(port), true
+}
+
+// GetPortRanges returns the nodePort ranges configured for namespace
+func (c *NamespaceNodePortConfig) GetPortRanges(namespace string) (PortRanges, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok {
+		return nil, false
+	}
+
+	return nsConfig.NodePortRanges, true
+}
+
+// HasNamespace reports whether a nodePort range is configured for namespace
+func (c *NamespaceNodePortConfig) HasNamespace(namespace string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	_, ok := c.getNamespace(namespace)
+	return ok
 }
 
 // check if port is in the range of requirements
 func (c *NamespaceNodePortConfig) IfMeetRequirements(namespace string, port int32) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
 	nsConfig, ok := c.getNamespace(namespace)
 	if !ok {
 		return false
 	}
 
-	return port <= nsConfig.NodePortRange.Max && port >= nsConfig.NodePortRange.Min
+	return nsConfig.inRange(port)
+}
+
+// Usage returns how many ports of the namespace ranges are in use and the total size of the ranges
+func (c *NamespaceNodePortConfig) Usage(namespace string) (int, int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok {
+		return 0, 0, fmt.Errorf("namespace %s does not exist", namespace)
+	}
+
+	return nsConfig.used(), nsConfig.size(), nil
 }
 
 func (c *NamespaceNodePortConfig) Len() int {
@@ -0,0 +1,216 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// PortRequest asks for one nodePort of a service
+type PortRequest struct {
+	// Port is the nodePort the service asks for or keeps, 0 lets the store pick one
+	Port int32
+	// Name of the ServicePort, a picked port prefers the one a deleted service of the
+	// same name used for it
+	Name string
+	// Protocols sharing the port, e.g. TCP and UDP of a DNS service
+	Protocols []string
+}
+
+// AllocatePorts 在一个事务中为owner分配requests中的所有端口，返回的端口与requests一一对应。
+// 任何一个端口无法满足时回滚本次分配的所有端口，包括超出范围、保留或者冲突的指定端口，
+// dryRun为true时计算同样的结果但总是回滚。
+func (c *NamespaceNodePortConfig) AllocatePorts(namespace, owner string, requests []PortRequest, dryRun bool) ([]int32, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	nsConfig, ok := c.getNamespace(namespace)
+	if !ok {
+		return nil, fmt.Errorf("namespace %s does not exist", namespace)
+	}
+
+	tx := &transaction{
+		c:         c,
+		nsConfig:  nsConfig,
+		namespace: namespace,
+		owner:     owner,
+		now:       time.Now(),
+		assigned:  make(map[int32]bool),
+	}
+	// 按事务开始之前的用量检查一次配额
+	if err := tx.checkQuota(requests); err != nil {
+		return nil, fmt.Errorf("%w, none of the %d nodePorts requested by %s were allocated", err, len(requests), owner)
+	}
+
+	ports := make([]int32, len(requests))
+	// 先记录指定的端口，自动选择的端口不会与它们重复
+	for i, request := range requests {
+		if request.Port == 0 {
+			continue
+		}
+		if err := tx.take(request.Port); err != nil {
+			tx.rollback()
+			return nil, fmt.Errorf("%w, none of the %d nodePorts requested by %s were allocated", err, len(requests), owner)
+		}
+		ports[i] = request.Port
+	}
+
+	var picked []int32
+	for i, request := range requests {
+		if request.Port != 0 {
+			continue
+		}
+		port, err := tx.pick(request.Name)
+		if err != nil {
+			tx.rollback()
+			return nil, fmt.Errorf("%w, none of the %d nodePorts requested by %s were allocated", err, len(requests), owner)
+		}
+		ports[i] = port
+		picked = append(picked, port)
+	}
+
+	if dryRun {
+		tx.rollback()
+		return ports, nil
+	}
+	for _, port := range picked {
+		nsConfig.allocator.Allocated(port)
+	}
+
+	// 同一个端口可能被多个请求使用，合并它们的协议
+	protocols := make(map[int32][]string)
+	for i, request := range requests {
+		protocols[ports[i]] = append(protocols[ports[i]], request.Protocols...)
+	}
+	for port, p := range protocols {
+		if alloc, ok := nsConfig.Allocations[port]; ok && alloc.Owner == owner && len(p) > 0 {
+			alloc.setProtocols(p)
+		}
+	}
+	return ports, nil
+}
+
+// transaction records the ports taken for one service so that they can be given back
+type transaction struct {
+	c         *NamespaceNodePortConfig
+	nsConfig  *NamespaceConfig
+	namespace string
+	owner     string
+	now       time.Time
+	// assigned holds every port handed to the service so far
+	assigned map[int32]bool
+	undo     []undoEntry
+}
+
+// undoEntry is a port that was free before the transaction took it, or a port the transaction
+// handed over from the previous service of the owner
+type undoEntry struct {
+	port     int32
+	cooldown Cooldown
+	cooling  bool
+	// handover is the allocation handed over, with its handover deadline before the transaction
+	handover      *Allocation
+	handoverUntil time.Time
+}
+
+// checkQuota checks whether the namespace may take every port of requests it does not hold
+// yet: the free explicit ports and the ports to pick, except remembered ports the owner
+// still holds
+func (tx *transaction) checkQuota(requests []PortRequest) error {
+	explicit := make(map[int32]bool)
+	n := 0
+	for _, request := range requests {
+		if request.Port != 0 {
+			if tx.nsConfig.inRange(request.Port) && !tx.nsConfig.isAllocated(request.Port) && !explicit[request.Port] {
+				explicit[request.Port] = true
+				n++
+			}
+			continue
+		}
+		if port, ok := tx.c.stickyPort(tx.nsConfig, tx.owner, request.Name); ok && tx.nsConfig.isAllocated(port) {
+			continue
+		}
+		n++
+	}
+	if n == 0 {
+		return nil
+	}
+
+	return tx.nsConfig.checkQuota(tx.namespace, n)
+}
+
+// take reserves port for the owner, remembering how to give it back
+func (tx *transaction) take(port int32) error {
+	tx.assigned[port] = true
+	// owner已经持有的端口不再检查范围、保留和冲突，包括记录为foreign或者unmanaged的端口
+	if tx.c.holds(tx.namespace, tx.owner, port) {
+		return nil
+	}
+	cooldown, cooling := tx.nsConfig.cooldown[port]
+	taken, err := tx.c.markAllocated(tx.nsConfig, tx.namespace, tx.owner, port, tx.now)
+	if err != nil {
+		return err
+	}
+	if taken {
+		tx.undo = append(tx.undo, undoEntry{port: port, cooldown: cooldown, cooling: cooling})
+	}
+	return nil
+}
+
+// pick hands out the port a deleted service of the same name used for portName, or the
+// next port chosen by the allocator of the namespace
+func (tx *transaction) pick(portName string) (int32, error) {
+	if port, ok := tx.c.stickyPort(tx.nsConfig, tx.owner, portName); ok && !tx.assigned[port] {
+		if tx.nsConfig.isAllocated(port) {
+			tx.handover(port)
+			klog.V(2).Infof("reused nodePort %d still held by %s for port %q", port, tx.owner, portName)
+			return port, nil
+		}
+		err := tx.take(port)
+		if err == nil {
+			klog.V(2).Infof("reused nodePort %d of %s for port %q", port, tx.owner, portName)
+			return port, nil
+		}
+		klog.V(2).Infof("cannot reuse nodePort %d of %s: %v", port, tx.owner, err)
+	}
+
+	port, ok := tx.nsConfig.allocator.Pick(tx.nsConfig.portPool, func(port int32) bool {
+		return tx.assigned[port] || tx.c.isReserved(tx.nsConfig, port) || tx.nsConfig.coolingDown(port, tx.now)
+	})
+	if !ok {
+		return 0, fmt.Errorf("no available port in namespace %s", tx.namespace)
+	}
+	tx.nsConfig.take(tx.namespace, port, tx.owner, "", tx.now.Add(tx.c.ReservationTTL))
+	tx.assigned[port] = true
+	tx.undo = append(tx.undo, undoEntry{port: port})
+	return port, nil
+}
+
+// handover hands a port the owner still holds to the service being admitted, e.g. when a
+// service is recreated before the delete event of the old one is handled. The confirmed
+// allocation is left as it is, the admission may still be rejected as a duplicate create of a
+// live service. Only when the old UID releases the port within ReservationTTL it becomes a
+// reservation for the new service instead of being freed.
+func (tx *transaction) handover(port int32) {
+	alloc := tx.nsConfig.Allocations[port]
+	tx.assigned[port] = true
+	tx.undo = append(tx.undo, undoEntry{port: port, handover: alloc, handoverUntil: alloc.handoverUntil})
+	alloc.handoverUntil = tx.now.Add(tx.c.ReservationTTL)
+}
+
+// rollback gives back every port the transaction took, in reverse order
+func (tx *transaction) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		entry := tx.undo[i]
+		if entry.handover != nil {
+			entry.handover.handoverUntil = entry.handoverUntil
+			continue
+		}
+		tx.nsConfig.untake(entry.port)
+		if entry.cooling {
+			tx.nsConfig.cooldown[entry.port] = entry.cooldown
+		}
+	}
+	tx.undo = nil
+}
@@ -0,0 +1,224 @@
+package store
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// heldPorts maps every recorded port to its owner
+func heldPorts(c *NamespaceNodePortConfig) map[int32]string {
+	held := make(map[int32]string)
+	for _, alloc := range c.Snapshot() {
+		held[alloc.Port] = alloc.Owner
+	}
+	return held
+}
+
+func confirm(t *testing.T, c *NamespaceNodePortConfig, name string, ports ...int32) {
+	t.Helper()
+	if err := c.ConfirmPorts("ns", OwnerKey("ns", name), name+"-uid", ports, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAllocatePorts(t *testing.T) {
+	tests := []struct {
+		name     string
+		setup    func(t *testing.T, c *NamespaceNodePortConfig)
+		requests []PortRequest
+		dryRun   bool
+		// wantErr is a part of the error, empty when the transaction succeeds
+		wantErr   string
+		wantPorts []int32
+		// wantHeld is every port recorded after the transaction and its owner
+		wantHeld map[int32]string
+		check    func(t *testing.T, c *NamespaceNodePortConfig)
+	}{
+		{
+			name:      "explicit ports first, picks skip them",
+			requests:  []PortRequest{{Name: "x"}, {Port: 30000}, {Name: "y"}},
+			wantPorts: []int32{30001, 30000, 30002},
+			wantHeld:  map[int32]string{30000: "ns/a", 30001: "ns/a", 30002: "ns/a"},
+		},
+		{
+			name:     "rollback after a partial pick",
+			setup:    func(t *testing.T, c *NamespaceNodePortConfig) { confirm(t, c, "b", 30000, 30001, 30002) },
+			requests: []PortRequest{{Name: "x"}, {Name: "y"}, {Name: "z"}},
+			wantErr:  "no available port in namespace ns, none of the 3 nodePorts requested by ns/a were allocated",
+			wantHeld: map[int32]string{30000: "ns/b", 30001: "ns/b", 30002: "ns/b"},
+		},
+		{
+			name:     "conflicting explicit port rolls back the others",
+			setup:    func(t *testing.T, c *NamespaceNodePortConfig) { confirm(t, c, "b", 30004) },
+			requests: []PortRequest{{Port: 30001}, {Port: 30004}, {Name: "x"}},
+			wantErr:  "port 30004 is already allocated to ns/b",
+			wantHeld: map[int32]string{30004: "ns/b"},
+		},
+		{
+			name:     "out of range explicit port rolls back the others",
+			requests: []PortRequest{{Port: 30001}, {Port: 31000}},
+			wantErr:  "port 31000 is out of range for namespace ns",
+			wantHeld: map[int32]string{},
+		},
+		{
+			name: "reserved explicit port not held yet",
+			setup: func(t *testing.T, c *NamespaceNodePortConfig) {
+				if err := c.SetReserved("", PortRanges{{Min: 30002, Max: 30002}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			requests: []PortRequest{{Port: 30002}},
+			wantErr:  "port 30002 is reserved for namespace ns",
+			wantHeld: map[int32]string{},
+		},
+		{
+			name: "rollback restores the cooldown of an explicit port",
+			setup: func(t *testing.T, c *NamespaceNodePortConfig) {
+				c.ReleaseCooldown = time.Hour
+				confirm(t, c, "old", 30001)
+				if err := c.ReleasePorts("ns", "ns/old", "old-uid", []int32{30001}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			requests: []PortRequest{{Port: 30001}, {Port: 31000}},
+			wantErr:  "out of range",
+			wantHeld: map[int32]string{},
+			check: func(t *testing.T, c *NamespaceNodePortConfig) {
+				if cooldowns := c.Cooldowns(); len(cooldowns) != 1 || cooldowns[0].Port != 30001 {
+					t.Errorf("cooldowns %v, want port 30001 cooling down", cooldowns)
+				}
+			},
+		},
+		{
+			name: "picks skip ports cooling down",
+			setup: func(t *testing.T, c *NamespaceNodePortConfig) {
+				c.ReleaseCooldown = time.Hour
+				confirm(t, c, "old", 30000)
+				if err := c.ReleasePorts("ns", "ns/old", "old-uid", []int32{30000}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			requests:  []PortRequest{{Name: "x"}},
+			wantPorts: []int32{30001},
+			wantHeld:  map[int32]string{30001: "ns/a"},
+		},
+		{
+			name:     "rollback restores the handover of a remembered port",
+			setup:    rememberHTTP,
+			requests: []PortRequest{{Name: "http"}, {Port: 31000}},
+			wantErr:  "out of range",
+			wantHeld: map[int32]string{30000: "ns/a"},
+			check:    expectNoHandover,
+		},
+		{
+			name:      "dry run keeps the remembered port as it is",
+			setup:     rememberHTTP,
+			requests:  []PortRequest{{Name: "http"}},
+			dryRun:    true,
+			wantPorts: []int32{30000},
+			wantHeld:  map[int32]string{30000: "ns/a"},
+			check:     expectNoHandover,
+		},
+		{
+			name:      "dry run computes the ports and rolls them back",
+			requests:  []PortRequest{{Name: "x"}, {Port: 30003}},
+			dryRun:    true,
+			wantPorts: []int32{30000, 30003},
+			wantHeld:  map[int32]string{},
+		},
+		{
+			name: "quota is checked once against the usage before the transaction",
+			setup: func(t *testing.T, c *NamespaceNodePortConfig) {
+				if err := c.SetQuota("ns", 0, 2); err != nil {
+					t.Fatal(err)
+				}
+			},
+			requests: []PortRequest{{Name: "x"}, {Name: "y"}, {Port: 30004}},
+			wantErr:  "namespace ns uses 0 of its 2 nodePort quota, cannot take 3 more",
+			wantHeld: map[int32]string{},
+		},
+		{
+			name: "quota does not count ports the owner holds",
+			setup: func(t *testing.T, c *NamespaceNodePortConfig) {
+				confirm(t, c, "a", 30000, 30001)
+				if err := c.SetQuota("ns", 0, 3); err != nil {
+					t.Fatal(err)
+				}
+			},
+			requests:  []PortRequest{{Port: 30000}, {Port: 30001}, {Name: "x"}},
+			wantPorts: []int32{30000, 30001, 30002},
+			wantHeld:  map[int32]string{30000: "ns/a", 30001: "ns/a", 30002: "ns/a"},
+		},
+		{
+			name:      "unmanaged port held by the owner",
+			setup:     func(t *testing.T, c *NamespaceNodePortConfig) { confirm(t, c, "a", 31000) },
+			requests:  []PortRequest{{Port: 31000}, {Name: "x"}},
+			wantPorts: []int32{31000, 30000},
+			wantHeld:  map[int32]string{30000: "ns/a", 31000: "ns/a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewNamespaceNodePortConfig()
+			if err := c.AddNamespace("ns", PortRanges{{Min: 30000, Max: 30004}}); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.SetAllocator("ns", firstFit{}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.setup != nil {
+				tt.setup(t, c)
+			}
+
+			ports, err := c.AllocatePorts("ns", "ns/a", tt.requests, tt.dryRun)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("AllocatePorts() failed: %v", err)
+			case tt.wantErr != "" && err == nil:
+				t.Fatalf("AllocatePorts() = %v, want error %q", ports, tt.wantErr)
+			case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+				t.Fatalf("AllocatePorts() failed with %q, want %q", err, tt.wantErr)
+			}
+			if len(ports) != len(tt.wantPorts) {
+				t.Fatalf("AllocatePorts() = %v, want %v", ports, tt.wantPorts)
+			}
+			for i := range ports {
+				if ports[i] != tt.wantPorts[i] {
+					t.Fatalf("AllocatePorts() = %v, want %v", ports, tt.wantPorts)
+				}
+			}
+
+			held := heldPorts(c)
+			if len(held) != len(tt.wantHeld) {
+				t.Fatalf("held ports %v, want %v", held, tt.wantHeld)
+			}
+			for port, owner := range tt.wantHeld {
+				if held[port] != owner {
+					t.Errorf("port %d held by %q, want %q", port, held[port], owner)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, c)
+			}
+		})
+	}
+}
+
+// rememberHTTP records 30000 as the confirmed port http of ns/a
+func rememberHTTP(t *testing.T, c *NamespaceNodePortConfig) {
+	c.StickyRetention = time.Hour
+	confirm(t, c, "a", 30000)
+	c.RememberPorts("ns", "ns/a", map[string]int32{"http": 30000})
+}
+
+// expectNoHandover checks that releasing the port of the old UID frees it
+func expectNoHandover(t *testing.T, c *NamespaceNodePortConfig) {
+	if err := c.ReleasePorts("ns", "ns/a", "a-uid", []int32{30000}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := heldPorts(c)[30000]; ok {
+		t.Error("port 30000 was handed over by a transaction that was rolled back")
+	}
+}
@@ -2,15 +2,35 @@ package webhook
 
 import (
 	"crypto/tls"
+
+	"github.com/tiggoins/port-allocator/certs"
 	"k8s.io/klog/v2"
 )
 
+// GetCertificateFunc returns the certificate to serve, see tls.Config.GetCertificate
+type GetCertificateFunc func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+
+// UseCertificateSource makes the server take its certificate from getCertificate
+// instead of the --tls-cert-file and --tls-key-file flags
+func (s *Server) UseCertificateSource(getCertificate GetCertificateFunc) {
+	s.getCertificate = getCertificate
+}
+
 func (s *Server) configTLS() *tls.Config {
-	cert, err := tls.LoadX509KeyPair(s.certfile, s.keyfile)
+	if s.getCertificate != nil {
+		return &tls.Config{
+			GetCertificate: s.getCertificate,
+		}
+	}
+
+	// 证书文件变化时自动重新加载，无需重启
+	reloader, err := certs.NewKeyPairReloader(s.certfile, s.keyfile)
 	if err != nil {
 		klog.Fatal(err)
 	}
+	go reloader.Run(s.ctx.Done())
+
 	return &tls.Config{
-		Certificates: []tls.Certificate{cert},
+		GetCertificate: reloader.GetCertificate,
 	}
 }
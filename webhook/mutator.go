@@ -1,6 +1,10 @@
 package webhook
 
 import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/tiggoins/port-allocator/k8s"
 	"github.com/tiggoins/port-allocator/store"
 	v1 "k8s.io/api/admission/v1"
 	corev1 "k8s.io/api/core/v1"
@@ -12,6 +16,13 @@ type Mutator struct {
 	s *store.NamespaceNodePortConfig
 }
 
+// patchOperation is a single RFC 6902 JSONPatch operation
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
 func NewMutator(ss *store.NamespaceNodePortConfig) *Mutator {
 	return &Mutator{s: ss}
 }
@@ -38,16 +49,183 @@ func (mu *Mutator) mutateService(ar *v1.AdmissionReview) *v1.AdmissionResponse {
 		return reviewResponse
 	}
 
-	// permit if serive.type is not nodePort
-	if service.Spec.Type != corev1.ServiceTypeNodePort {
-		klog.V(2).Infof("Service %s/%s is not nodeport type,will allow the request.", ar.Request.Namespace, ar.Request.Name)
+	// 更新操作需要和旧对象对比，保留已有端口。被移除的端口在informer观察到更新后释放，
+	// 准入请求之后仍可能被拒绝
+	var oldService *corev1.Service
+	if ar.Request.Operation == v1.Update {
+		oldService = &corev1.Service{}
+		if _, _, err := deserializer.Decode(ar.Request.OldObject.Raw, nil, oldService); err != nil {
+			klog.Error(err)
+			reviewResponse.Allowed = false
+			reviewResponse.Result = &metav1.Status{
+				Reason:  metav1.StatusReasonInternalError,
+				Message: "Cannot decode old object into v1.Service",
+			}
+			return reviewResponse
+		}
+	}
+
+	namespace := ar.Request.Namespace
+	if namespace == "" {
+		namespace = service.Namespace
+	}
+
+	owner := store.OwnerKey(namespace, service.Name)
+	// namespace没有配置范围时按默认策略处理
+	if !mu.s.HasNamespace(namespace) {
+		if !k8s.ConsumesNodePorts(&service) {
+			return reviewResponse
+		}
+		return applyDefaultPolicy(mu.s, reviewResponse, namespace, owner, true)
+	}
+
+	// permit if service does not consume nodePorts
+	if !k8s.ConsumesNodePorts(&service) {
+		klog.V(2).Infof("Service %s/%s is neither nodeport nor loadbalancer type,will allow the request.", ar.Request.Namespace, ar.Request.Name)
 		return reviewResponse
 	}
+	// dry-run请求返回同样的patch，但不修改store
+	dryRun := ar.Request.DryRun != nil && *ar.Request.DryRun
+
+	previous := previousNodePorts(oldService, &service)
 
+	// 收集service的所有端口，在一个事务中分配，任何一个端口分配失败时全部回滚。
+	// 相同port的TCP/UDP等不同协议共用一个nodePort，只发出一个请求
+	var requests []store.PortRequest
+	var paths [][]string
+	byPort := make(map[int32]int)
 	for i := 0; i < len(service.Spec.Ports); i++ {
-		// 添加的nodeport是否在范围内的逻辑，不在则强制修改到范围内
-		service.Spec.Ports[i].NodePort = 30000
+		servicePort := service.Spec.Ports[i]
+		nodePort := servicePort.NodePort
+		prev := previous[servicePort.Name]
+		// allocateLoadBalancerNodePorts为false时只记录用户指定的端口
+		if nodePort == 0 && prev == 0 && !k8s.AllocatesNodePorts(&service) {
+			continue
+		}
+		path := fmt.Sprintf("/spec/ports/%d/nodePort", i)
+		protocol := k8s.Protocol(servicePort)
+		if j, ok := byPort[servicePort.Port]; ok && nodePort == 0 && (prev == 0 || prev == requests[j].Port) && !hasProtocol(requests[j], protocol) {
+			requests[j].Protocols = append(requests[j].Protocols, protocol)
+			paths[j] = append(paths[j], path)
+			continue
+		}
+		request, patchPath := portRequest(nodePort, prev, servicePort.Name, path)
+		request.Protocols = []string{protocol}
+		if _, ok := byPort[servicePort.Port]; !ok {
+			byPort[servicePort.Port] = len(requests)
+		}
+		requests = append(requests, request)
+		paths = append(paths, pathsOf(patchPath))
+	}
+
+	if k8s.NeedsHealthCheckNodePort(&service) {
+		var prev int32
+		if oldService != nil && k8s.NeedsHealthCheckNodePort(oldService) {
+			prev = oldService.Spec.HealthCheckNodePort
+		}
+		request, path := portRequest(service.Spec.HealthCheckNodePort, prev, k8s.HealthCheckPortName, "/spec/healthCheckNodePort")
+		request.Protocols = []string{string(corev1.ProtocolTCP)}
+		requests = append(requests, request)
+		paths = append(paths, pathsOf(path))
+	}
+
+	inUse, err := mu.s.AllocatePorts(namespace, owner, requests, dryRun)
+	if err != nil {
+		return allocationFailed(reviewResponse, owner, err)
+	}
+
+	if len(inUse) > 0 && mu.s.InCatchAll(namespace) {
+		reviewResponse.Warnings = append(reviewResponse.Warnings,
+			fmt.Sprintf("namespace %s has no nodePort range configured, nodePorts of service %s come from the shared range of the default policy %s", namespace, owner, store.DefaultCatchAll))
+	}
+
+	var patches []patchOperation
+	for i, port := range inUse {
+		for _, path := range paths[i] {
+			klog.V(2).Infof("Assigned nodePort %d at %s for service %s (dryRun=%t)", port, path, owner, dryRun)
+			patches = append(patches, patchOperation{Op: "add", Path: path, Value: port})
+		}
+	}
+
+	if len(patches) == 0 {
+		return reviewResponse
+	}
+
+	patchBytes, err := json.Marshal(patches)
+	if err != nil {
+		klog.Error(err)
+		reviewResponse.Allowed = false
+		reviewResponse.Result = &metav1.Status{
+			Reason:  metav1.StatusReasonInternalError,
+			Message: "Cannot marshal JSONPatch",
+		}
+		return reviewResponse
+	}
+
+	patchType := v1.PatchTypeJSONPatch
+	reviewResponse.Patch = patchBytes
+	reviewResponse.PatchType = &patchType
+
+	return reviewResponse
+}
+
+// portRequest returns the store request for a nodePort and the path to patch with the
+// result. Explicit nodePorts are kept as they are, the store denies out of range, reserved or
+// conflicting ones. On update the previous nodePort is carried over.
+func portRequest(nodePort, previous int32, portName, path string) (store.PortRequest, string) {
+	if nodePort != 0 {
+		return store.PortRequest{Port: nodePort, Name: portName}, ""
+	}
+	if previous != 0 {
+		return store.PortRequest{Port: previous, Name: portName}, path
+	}
+	return store.PortRequest{Name: portName}, path
+}
+
+func pathsOf(path string) []string {
+	if path == "" {
+		return nil
+	}
+	return []string{path}
+}
+
+func hasProtocol(request store.PortRequest, protocol string) bool {
+	for _, p := range request.Protocols {
+		if p == protocol {
+			return true
+		}
+	}
+	return false
+}
+
+// previousNodePorts maps the names of the old ServicePorts to their nodePorts, the same way
+// the apiserver carries nodePorts over on update. Ports explicitly reused elsewhere in the
+// new object are left out.
+func previousNodePorts(oldService, service *corev1.Service) map[string]int32 {
+	previous := make(map[string]int32)
+	if oldService == nil || !k8s.ConsumesNodePorts(oldService) {
+		return previous
 	}
 
+	explicit := make(map[int32]bool)
+	for _, port := range service.Spec.Ports {
+		explicit[port.NodePort] = true
+	}
+	for _, port := range oldService.Spec.Ports {
+		if port.NodePort != 0 && !explicit[port.NodePort] {
+			previous[port.Name] = port.NodePort
+		}
+	}
+
+	return previous
+}
+
+func allocationFailed(reviewResponse *v1.AdmissionResponse, owner string, err error) *v1.AdmissionResponse {
+	klog.Error(err)
+	reviewResponse.Allowed = false
+	reviewResponse.Result = &metav1.Status{
+		Reason:  metav1.StatusReasonForbidden,
+		Message: fmt.Sprintf("Cannot allocate nodePort for %s: %v", owner, err),
+	}
 	return reviewResponse
 }
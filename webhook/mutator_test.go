@@ -0,0 +1,331 @@
+package webhook
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/tiggoins/port-allocator/store"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// newTestStore returns a store where namespace ns uses 30000-30010 and namespace other 30100-30110
+func newTestStore(t *testing.T) *store.NamespaceNodePortConfig {
+	t.Helper()
+	s := store.NewNamespaceNodePortConfig()
+	if err := s.AddNamespace("ns", store.PortRanges{{Min: 30000, Max: 30010}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddNamespace("other", store.PortRanges{{Min: 30100, Max: 30110}}); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func newService(name string, ports ...corev1.ServicePort) *corev1.Service {
+	return &corev1.Service{
+		TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Service"},
+		ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: name, UID: types.UID(name + "-uid")},
+		Spec:       corev1.ServiceSpec{Type: corev1.ServiceTypeNodePort, Ports: ports},
+	}
+}
+
+func servicePort(name string, port int32, protocol corev1.Protocol, nodePort int32) corev1.ServicePort {
+	return corev1.ServicePort{Name: name, Port: port, Protocol: protocol, NodePort: nodePort}
+}
+
+// withLabel returns a copy of service with a label set, an update that changes no port
+func withLabel(service *corev1.Service) *corev1.Service {
+	service = service.DeepCopy()
+	service.Labels = map[string]string{"edited": "true"}
+	return service
+}
+
+func newReview(t *testing.T, op v1.Operation, oldService, service *corev1.Service, dryRun bool) *v1.AdmissionReview {
+	t.Helper()
+	raw := func(service *corev1.Service) runtime.RawExtension {
+		if service == nil {
+			return runtime.RawExtension{}
+		}
+		b, err := json.Marshal(service)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return runtime.RawExtension{Raw: b}
+	}
+
+	return &v1.AdmissionReview{Request: &v1.AdmissionRequest{
+		Operation: op,
+		Namespace: service.Namespace,
+		Name:      service.Name,
+		Object:    raw(service),
+		OldObject: raw(oldService),
+		DryRun:    &dryRun,
+	}}
+}
+
+// patchedPorts maps the paths patched by resp to their nodePort
+func patchedPorts(t *testing.T, resp *v1.AdmissionResponse) map[string]int32 {
+	t.Helper()
+	if resp.Patch == nil {
+		return nil
+	}
+	var patches []struct {
+		Path  string `json:"path"`
+		Value int32  `json:"value"`
+	}
+	if err := json.Unmarshal(resp.Patch, &patches); err != nil {
+		t.Fatal(err)
+	}
+	ports := make(map[string]int32)
+	for _, patch := range patches {
+		ports[patch.Path] = patch.Value
+	}
+	return ports
+}
+
+type mutateTest struct {
+	name       string
+	setup      func(t *testing.T, s *store.NamespaceNodePortConfig)
+	op         v1.Operation
+	oldService *corev1.Service
+	service    *corev1.Service
+	dryRun     bool
+	// wantDenied is a part of the denial message, empty when the request is allowed
+	wantDenied  string
+	wantPatches map[string]int32
+	// check inspects the store after the request
+	check func(t *testing.T, s *store.NamespaceNodePortConfig)
+}
+
+func runMutateTests(t *testing.T, tests []mutateTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			if tt.setup != nil {
+				tt.setup(t, s)
+			}
+
+			resp := NewMutator(s).mutateService(newReview(t, tt.op, tt.oldService, tt.service, tt.dryRun))
+			if tt.wantDenied == "" && !resp.Allowed {
+				t.Fatalf("request denied: %s", resp.Result.Message)
+			}
+			if tt.wantDenied != "" {
+				if resp.Allowed {
+					t.Fatalf("request allowed, want it denied with %q", tt.wantDenied)
+				}
+				if !strings.Contains(resp.Result.Message, tt.wantDenied) {
+					t.Fatalf("request denied with %q, want %q", resp.Result.Message, tt.wantDenied)
+				}
+			}
+
+			got := patchedPorts(t, resp)
+			if len(got) != len(tt.wantPatches) {
+				t.Fatalf("patched %v, want %v", got, tt.wantPatches)
+			}
+			for path, port := range tt.wantPatches {
+				if got[path] != port {
+					t.Errorf("patched %s with %d, want %d", path, got[path], port)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, s)
+			}
+		})
+	}
+}
+
+// hold records port as used by the service name of namespace ns
+func hold(name string, ports ...int32) func(t *testing.T, s *store.NamespaceNodePortConfig) {
+	return func(t *testing.T, s *store.NamespaceNodePortConfig) {
+		t.Helper()
+		if err := s.AddPortToNamespace("ns", store.OwnerKey("ns", name), name+"-uid", ports, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMutateUpdateKeepsHeldPorts(t *testing.T) {
+	unmanaged := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 31000))
+	reserved := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30005))
+	foreign := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30105))
+
+	runMutateTests(t, []mutateTest{
+		{
+			name:  "unmanaged port held by the service",
+			setup: hold("a", 31000),
+			op:    v1.Update, oldService: unmanaged, service: withLabel(unmanaged),
+		},
+		{
+			name: "reserved port held by the service",
+			setup: func(t *testing.T, s *store.NamespaceNodePortConfig) {
+				hold("a", 30005)(t, s)
+				if err := s.SetReserved("", store.PortRanges{{Min: 30005, Max: 30005}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			op: v1.Update, oldService: reserved, service: withLabel(reserved),
+		},
+		{
+			name:  "foreign port held by the service",
+			setup: hold("a", 30105),
+			op:    v1.Update, oldService: foreign, service: withLabel(foreign),
+		},
+		{
+			name:       "unmanaged port not held yet",
+			op:         v1.Create,
+			service:    unmanaged,
+			wantDenied: "port 31000 is out of range for namespace ns",
+		},
+		{
+			name:       "foreign port held by another service",
+			setup:      hold("b", 30105),
+			op:         v1.Create,
+			service:    foreign,
+			wantDenied: "port 30105 is out of range for namespace ns",
+		},
+	})
+}
+
+func TestMutateService(t *testing.T) {
+	twoPorts := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 0), servicePort("https", 443, corev1.ProtocolTCP, 0))
+	dns := newService("a", servicePort("dns-tcp", 53, corev1.ProtocolTCP, 0), servicePort("dns-udp", 53, corev1.ProtocolUDP, 0))
+	dnsExplicit := newService("a", servicePort("dns-udp", 53, corev1.ProtocolUDP, 30005), servicePort("dns-tcp", 53, corev1.ProtocolTCP, 0))
+	held := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30002))
+	cleared := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 0))
+	both := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30000), servicePort("https", 443, corev1.ProtocolTCP, 30001))
+	httpOnly := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30000))
+	added := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30000), servicePort("https", 443, corev1.ProtocolTCP, 0))
+	conflict := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 0), servicePort("https", 443, corev1.ProtocolTCP, 30003))
+	clusterIP := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 0))
+	clusterIP.Spec.Type = corev1.ServiceTypeClusterIP
+
+	runMutateTests(t, []mutateTest{
+		{
+			name:        "create assigns a nodePort to every port",
+			op:          v1.Create,
+			service:     twoPorts,
+			wantPatches: map[string]int32{"/spec/ports/0/nodePort": 30000, "/spec/ports/1/nodePort": 30001},
+			check:       expectOwned("ns/a", 30000, 30001),
+		},
+		{
+			name:        "TCP and UDP of the same port share a nodePort",
+			op:          v1.Create,
+			service:     dns,
+			wantPatches: map[string]int32{"/spec/ports/0/nodePort": 30000, "/spec/ports/1/nodePort": 30000},
+			check: func(t *testing.T, s *store.NamespaceNodePortConfig) {
+				expectOwned("ns/a", 30000)(t, s)
+				for _, alloc := range s.Snapshot() {
+					if len(alloc.Protocols) != 2 {
+						t.Errorf("port %d records protocols %v, want TCP and UDP", alloc.Port, alloc.Protocols)
+					}
+				}
+			},
+		},
+		{
+			name:        "TCP port joins the explicit nodePort of its UDP pair",
+			op:          v1.Create,
+			service:     dnsExplicit,
+			wantPatches: map[string]int32{"/spec/ports/1/nodePort": 30005},
+			check:       expectOwned("ns/a", 30005),
+		},
+		{
+			name:        "update carries a cleared nodePort over",
+			setup:       hold("a", 30002),
+			op:          v1.Update,
+			oldService:  held,
+			service:     cleared,
+			wantPatches: map[string]int32{"/spec/ports/0/nodePort": 30002},
+			check:       expectOwned("ns/a", 30002),
+		},
+		{
+			name:       "update removing a port releases nothing at admission",
+			setup:      hold("a", 30000, 30001),
+			op:         v1.Update,
+			oldService: both,
+			service:    httpOnly,
+			check:      expectOwned("ns/a", 30000, 30001),
+		},
+		{
+			name:        "update adding a port picks a free one",
+			setup:       hold("a", 30000),
+			op:          v1.Update,
+			oldService:  httpOnly,
+			service:     added,
+			wantPatches: map[string]int32{"/spec/ports/1/nodePort": 30001},
+			check:       expectOwned("ns/a", 30000, 30001),
+		},
+		{
+			name:        "dry run patches without touching the store",
+			op:          v1.Create,
+			service:     twoPorts,
+			dryRun:      true,
+			wantPatches: map[string]int32{"/spec/ports/0/nodePort": 30000, "/spec/ports/1/nodePort": 30001},
+			check:       expectOwned("ns/a"),
+		},
+		{
+			name:       "full namespace denies and allocates nothing",
+			setup:      hold("b", 30000, 30001, 30002, 30003, 30004, 30005, 30006, 30007, 30008, 30009),
+			op:         v1.Create,
+			service:    twoPorts,
+			wantDenied: "no available port in namespace ns, none of the 2 nodePorts requested by ns/a were allocated",
+			check:      expectOwned("ns/a"),
+		},
+		{
+			name:       "conflicting explicit port denies and allocates nothing",
+			setup:      hold("b", 30003),
+			op:         v1.Create,
+			service:    conflict,
+			wantDenied: "port 30003 is already allocated to ns/b",
+			check:      expectOwned("ns/a"),
+		},
+		{
+			name: "quota denies and allocates nothing",
+			setup: func(t *testing.T, s *store.NamespaceNodePortConfig) {
+				if err := s.SetQuota("ns", 0, 1); err != nil {
+					t.Fatal(err)
+				}
+			},
+			op:         v1.Create,
+			service:    twoPorts,
+			wantDenied: "namespace ns uses 0 of its 1 nodePort quota, cannot take 2 more",
+			check:      expectOwned("ns/a"),
+		},
+		{
+			name:    "ClusterIP service is left alone",
+			op:      v1.Create,
+			service: clusterIP,
+			check:   expectOwned("ns/a"),
+		},
+	})
+}
+
+// expectOwned checks that owner holds exactly ports
+func expectOwned(owner string, ports ...int32) func(t *testing.T, s *store.NamespaceNodePortConfig) {
+	return func(t *testing.T, s *store.NamespaceNodePortConfig) {
+		t.Helper()
+		want := make(map[int32]bool)
+		for _, port := range ports {
+			want[port] = true
+		}
+		got := make(map[int32]bool)
+		for _, alloc := range s.Snapshot() {
+			if alloc.Owner == owner {
+				got[alloc.Port] = true
+			}
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s holds %v, want %v", owner, got, ports)
+		}
+		for port := range want {
+			if !got[port] {
+				t.Errorf("%s does not hold %d", owner, port)
+			}
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/tiggoins/port-allocator/store"
+	v1 "k8s.io/api/admission/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+// applyDefaultPolicy admits a service holding nodePorts in a namespace without a configured
+// range. The policy shows up in the denial or as a warning, so users know why their nodePorts
+// are not managed.
+func applyDefaultPolicy(s *store.NamespaceNodePortConfig, reviewResponse *v1.AdmissionResponse, namespace, owner string, warn bool) *v1.AdmissionResponse {
+	if s.DefaultPolicy == store.DefaultDeny {
+		return deny(reviewResponse, metav1.StatusReasonForbidden,
+			fmt.Sprintf("service %s is denied: namespace %s has no nodePort range configured and the default policy is %s", owner, namespace, s.DefaultPolicy))
+	}
+
+	klog.V(2).Infof("Namespace %s has no nodeport range configured,will allow the request.", namespace)
+	if warn {
+		reviewResponse.Warnings = append(reviewResponse.Warnings,
+			fmt.Sprintf("namespace %s has no nodePort range configured, nodePorts of service %s are not managed by port-allocator (default policy %s)", namespace, owner, s.DefaultPolicy))
+	}
+	return reviewResponse
+}
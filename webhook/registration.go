@@ -0,0 +1,190 @@
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/tiggoins/port-allocator/k8s"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// MutatePath is the path the mutating webhook is served on
+	MutatePath = "/port-allocator"
+	// ValidatePath is the path the validating webhook is served on
+	ValidatePath = "/port-allocator/validate"
+
+	webhookName = "port-allocator.tiggoins.github.io"
+
+	// reconcilePeriod is how often the leader corrects drift of the registration
+	reconcilePeriod = time.Minute
+)
+
+// RegistrationConfig describes the Mutating and ValidatingWebhookConfiguration the allocator
+// registers, both are named Name
+type RegistrationConfig struct {
+	Name string
+	// ServiceNamespace and ServiceName of the Service fronting the webhook
+	ServiceNamespace string
+	ServiceName      string
+	ServicePort      int32
+	// Namespaces with a configured nodePort range, used for the namespaceSelector
+	Namespaces []string
+	// AllNamespaces drops the namespaceSelector, needed when namespaces are matched by glob
+	// or label selector
+	AllNamespaces  bool
+	FailurePolicy  admissionregistrationv1.FailurePolicyType
+	TimeoutSeconds int32
+	// CABundle returns the CA to set, existing caBundle is kept when it returns nil
+	CABundle func() []byte
+}
+
+// Registrar creates and reconciles the Mutating and ValidatingWebhookConfiguration of the allocator
+type Registrar struct {
+	client kubernetes.Interface
+	config RegistrationConfig
+}
+
+func NewRegistrar(client kubernetes.Interface, config RegistrationConfig) *Registrar {
+	return &Registrar{client: client, config: config}
+}
+
+// Run reconciles the registration until ctx is done, it is meant to run on the leader only
+func (r *Registrar) Run(ctx context.Context) {
+	wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := r.reconcile(ctx); err != nil {
+			klog.Errorf("failed to reconcile MutatingWebhookConfiguration %s: %v", r.config.Name, err)
+		}
+		// validating webhook拒绝超出范围、冲突、保留或者超出配额的指定端口
+		if err := r.reconcileValidating(ctx); err != nil {
+			klog.Errorf("failed to reconcile ValidatingWebhookConfiguration %s: %v", r.config.Name, err)
+		}
+	}, reconcilePeriod)
+}
+
+func (r *Registrar) reconcile(ctx context.Context) error {
+	if len(r.config.Namespaces) == 0 && !r.config.AllNamespaces {
+		return fmt.Errorf("no namespace has a nodePort range configured")
+	}
+	return k8s.MutatingWebhookConfigs(r.client).Reconcile(ctx, r.config.Name, func(caBundle []byte) []admissionregistrationv1.MutatingWebhook {
+		return []admissionregistrationv1.MutatingWebhook{r.desiredWebhook(caBundle)}
+	})
+}
+
+func (r *Registrar) reconcileValidating(ctx context.Context) error {
+	if len(r.config.Namespaces) == 0 && !r.config.AllNamespaces {
+		return fmt.Errorf("no namespace has a nodePort range configured")
+	}
+	return k8s.ValidatingWebhookConfigs(r.client).Reconcile(ctx, r.config.Name, func(caBundle []byte) []admissionregistrationv1.ValidatingWebhook {
+		return []admissionregistrationv1.ValidatingWebhook{r.desiredValidatingWebhook(caBundle)}
+	})
+}
+
+// desiredWebhook builds the mutating webhook entry, falling back to currentCABundle when no CA is configured
+func (r *Registrar) desiredWebhook(currentCABundle []byte) admissionregistrationv1.MutatingWebhook {
+	failurePolicy := r.config.FailurePolicy
+	timeoutSeconds := r.config.TimeoutSeconds
+	sideEffects := admissionregistrationv1.SideEffectClassNoneOnDryRun
+	matchPolicy := admissionregistrationv1.Equivalent
+	reinvocationPolicy := admissionregistrationv1.NeverReinvocationPolicy
+
+	return admissionregistrationv1.MutatingWebhook{
+		Name:                    webhookName,
+		ClientConfig:            r.clientConfig(MutatePath, currentCABundle),
+		Rules:                   serviceRules(),
+		FailurePolicy:           &failurePolicy,
+		MatchPolicy:             &matchPolicy,
+		NamespaceSelector:       r.namespaceSelector(),
+		ObjectSelector:          &metav1.LabelSelector{},
+		SideEffects:             &sideEffects,
+		TimeoutSeconds:          &timeoutSeconds,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+		ReinvocationPolicy:      &reinvocationPolicy,
+	}
+}
+
+// desiredValidatingWebhook builds the validating webhook entry with the same selector,
+// failure policy and timeout as the mutating one
+func (r *Registrar) desiredValidatingWebhook(currentCABundle []byte) admissionregistrationv1.ValidatingWebhook {
+	failurePolicy := r.config.FailurePolicy
+	timeoutSeconds := r.config.TimeoutSeconds
+	sideEffects := admissionregistrationv1.SideEffectClassNone
+	matchPolicy := admissionregistrationv1.Equivalent
+
+	return admissionregistrationv1.ValidatingWebhook{
+		Name:                    webhookName,
+		ClientConfig:            r.clientConfig(ValidatePath, currentCABundle),
+		Rules:                   serviceRules(),
+		FailurePolicy:           &failurePolicy,
+		MatchPolicy:             &matchPolicy,
+		NamespaceSelector:       r.namespaceSelector(),
+		ObjectSelector:          &metav1.LabelSelector{},
+		SideEffects:             &sideEffects,
+		TimeoutSeconds:          &timeoutSeconds,
+		AdmissionReviewVersions: []string{"v1", "v1beta1"},
+	}
+}
+
+// clientConfig points at path of the webhook Service, falling back to currentCABundle when no CA is configured
+func (r *Registrar) clientConfig(path string, currentCABundle []byte) admissionregistrationv1.WebhookClientConfig {
+	caBundle := currentCABundle
+	if r.config.CABundle != nil {
+		if ca := r.config.CABundle(); len(ca) > 0 {
+			caBundle = ca
+		}
+	}
+
+	port := r.config.ServicePort
+	return admissionregistrationv1.WebhookClientConfig{
+		Service: &admissionregistrationv1.ServiceReference{
+			Namespace: r.config.ServiceNamespace,
+			Name:      r.config.ServiceName,
+			Path:      &path,
+			Port:      &port,
+		},
+		CABundle: caBundle,
+	}
+}
+
+func (r *Registrar) namespaceSelector() *metav1.LabelSelector {
+	namespaceSelector := &metav1.LabelSelector{}
+	if !r.config.AllNamespaces {
+		namespaces := append([]string(nil), r.config.Namespaces...)
+		sort.Strings(namespaces)
+		namespaceSelector.MatchExpressions = []metav1.LabelSelectorRequirement{{
+			Key:      corev1.LabelMetadataName,
+			Operator: metav1.LabelSelectorOpIn,
+			Values:   namespaces,
+		}}
+	}
+	return namespaceSelector
+}
+
+func serviceRules() []admissionregistrationv1.RuleWithOperations {
+	scope := admissionregistrationv1.NamespacedScope
+	return []admissionregistrationv1.RuleWithOperations{{
+		Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create, admissionregistrationv1.Update},
+		Rule: admissionregistrationv1.Rule{
+			APIGroups:   []string{""},
+			APIVersions: []string{"v1"},
+			Resources:   []string{"services"},
+			Scope:       &scope,
+		},
+	}}
+}
+
+// ParseFailurePolicy converts the --webhook-failure-policy flag
+func ParseFailurePolicy(policy string) (admissionregistrationv1.FailurePolicyType, error) {
+	switch admissionregistrationv1.FailurePolicyType(policy) {
+	case admissionregistrationv1.Fail, admissionregistrationv1.Ignore:
+		return admissionregistrationv1.FailurePolicyType(policy), nil
+	}
+	return "", fmt.Errorf("unknown failure policy %q, MUST be Fail or Ignore", policy)
+}
@@ -12,11 +12,12 @@ import (
 	"github.com/spf13/pflag"
 	"github.com/tiggoins/port-allocator/store"
 	v1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/klog/v2"
 )
 
-// admitv1beta1Func handles a v1 admission
+// admitv1Func handles a v1 admission, v1beta1 requests are converted before being passed in
 type admitv1Func func(*v1.AdmissionReview) *v1.AdmissionResponse
 
 type Server struct {
@@ -24,9 +25,10 @@ type Server struct {
 	keyfile  string
 	port     int
 	ctx      context.Context
-	admit    admitv1Func
 	server   *http.Server
 	s        *store.NamespaceNodePortConfig
+	// getCertificate 不为空时替代证书文件
+	getCertificate GetCertificateFunc
 }
 
 func NewServer(ctx context.Context, flag pflag.FlagSet, s *store.NamespaceNodePortConfig) *Server {
@@ -56,12 +58,20 @@ func NewServer(ctx context.Context, flag pflag.FlagSet, s *store.NamespaceNodePo
 	server.keyfile = keyfile
 	server.port = port
 	server.ctx = ctx
-	server.admit = NewMutator(server.s).mutateService
+	server.s = s
 
 	return server
 }
 
-func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+func (s *Server) serveMutate(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, NewMutator(s.s).mutateService)
+}
+
+func (s *Server) serveValidate(w http.ResponseWriter, r *http.Request) {
+	s.serve(w, r, NewValidator(s.s).validateService)
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request, admit admitv1Func) {
 	var body []byte
 	if data, err := io.ReadAll(r.Body); err == nil {
 		body = data
@@ -88,6 +98,19 @@ func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
 
 	var responseObj runtime.Object
 	switch *gvk {
+	case v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"):
+		requestedAdmissionReview, ok := obj.(*v1beta1.AdmissionReview)
+		if !ok {
+			klog.Errorf("Expected v1beta1.AdmissionReview but got: %T", obj)
+			return
+		}
+		responseAdmissionReview := &v1beta1.AdmissionReview{}
+		responseAdmissionReview.SetGroupVersionKind(*gvk)
+		// v1beta1的请求转换为v1后交给同一个admit处理，响应再转换回v1beta1
+		response := admit(&v1.AdmissionReview{Request: convertAdmissionRequestToV1(requestedAdmissionReview.Request)})
+		responseAdmissionReview.Response = convertAdmissionResponseToV1beta1(response)
+		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
+		responseObj = responseAdmissionReview
 	case v1.SchemeGroupVersion.WithKind("AdmissionReview"):
 		requestedAdmissionReview, ok := obj.(*v1.AdmissionReview)
 		if !ok {
@@ -96,7 +119,7 @@ func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
 		}
 		responseAdmissionReview := &v1.AdmissionReview{}
 		responseAdmissionReview.SetGroupVersionKind(*gvk)
-		responseAdmissionReview.Response = s.admit(requestedAdmissionReview)
+		responseAdmissionReview.Response = admit(requestedAdmissionReview)
 		responseAdmissionReview.Response.UID = requestedAdmissionReview.Request.UID
 		responseObj = responseAdmissionReview
 	default:
@@ -120,7 +143,8 @@ func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) Start() {
-	http.HandleFunc("/port-allocator", s.serve)
+	http.HandleFunc(MutatePath, s.serveMutate)
+	http.HandleFunc(ValidatePath, s.serveValidate)
 	http.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) { w.Write([]byte("ok")) })
 
 	logger := log.New(new(httpLogger), "", 0)
@@ -0,0 +1,109 @@
+package webhook
+
+import (
+	"fmt"
+
+	"github.com/tiggoins/port-allocator/k8s"
+	"github.com/tiggoins/port-allocator/store"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/klog/v2"
+)
+
+type Validator struct {
+	s *store.NamespaceNodePortConfig
+}
+
+func NewValidator(ss *store.NamespaceNodePortConfig) *Validator {
+	return &Validator{s: ss}
+}
+
+// validateService denies services adding an explicit nodePort that is reserved, outside the
+// namespace range or already held by another service
+func (va *Validator) validateService(ar *v1.AdmissionReview) *v1.AdmissionResponse {
+	klog.V(2).Infof("Port-allocator starts validating %s/%s by %s", ar.Request.Namespace, ar.Request.Name, ar.Request.UserInfo.Username)
+
+	reviewResponse := &v1.AdmissionResponse{Allowed: true}
+	// skip if operation is not create and update
+	if ar.Request.Operation != v1.Create && ar.Request.Operation != v1.Update {
+		return reviewResponse
+	}
+
+	service := corev1.Service{}
+	deserializer := Codecs.UniversalDeserializer()
+	if _, _, err := deserializer.Decode(ar.Request.Object.Raw, nil, &service); err != nil {
+		klog.Error(err)
+		reviewResponse.Allowed = false
+		reviewResponse.Result = &metav1.Status{
+			Reason:  metav1.StatusReasonInternalError,
+			Message: "Cannot decode object into v1.Service",
+		}
+		return reviewResponse
+	}
+
+	if !k8s.ConsumesNodePorts(&service) {
+		return reviewResponse
+	}
+
+	namespace := ar.Request.Namespace
+	if namespace == "" {
+		namespace = service.Namespace
+	}
+
+	owner := store.OwnerKey(namespace, service.Name)
+	nodePorts := k8s.ServiceNodePorts(&service)
+
+	// 只检查新增的端口，已经在使用保留、范围之外或者其他namespace端口的service仍然可以更新
+	added := nodePorts
+	if ar.Request.Operation == v1.Update {
+		oldService := corev1.Service{}
+		if _, _, err := deserializer.Decode(ar.Request.OldObject.Raw, nil, &oldService); err == nil {
+			added = k8s.AddedNodePorts(&oldService, &service)
+		}
+	}
+	for _, nodePort := range added {
+		if va.s.IsReserved(namespace, nodePort) {
+			return deny(reviewResponse, metav1.StatusReasonForbidden,
+				fmt.Sprintf("nodePort %d of service %s is reserved and cannot be used", nodePort, owner))
+		}
+	}
+
+	portRanges, ok := va.s.GetPortRanges(namespace)
+	if !ok {
+		// 警告已经由mutating webhook给出
+		return applyDefaultPolicy(va.s, reviewResponse, namespace, owner, false)
+	}
+
+	for _, nodePort := range added {
+		if !va.s.IfMeetRequirements(namespace, nodePort) {
+			return deny(reviewResponse, metav1.StatusReasonInvalid,
+				fmt.Sprintf("nodePort %d of service %s is out of range, namespace %s only allows nodePorts %s",
+					nodePort, owner, namespace, portRanges))
+		}
+
+		if holder, allocated := va.s.PortOwner(namespace, nodePort); allocated && holder != owner {
+			return deny(reviewResponse, metav1.StatusReasonAlreadyExists,
+				fmt.Sprintf("nodePort %d of service %s is already allocated to %s, namespace %s allows nodePorts %s",
+					nodePort, owner, holder, namespace, portRanges))
+		}
+	}
+
+	if err := va.s.CheckQuota(namespace, owner, nodePorts); err != nil {
+		return deny(reviewResponse, metav1.StatusReasonForbidden,
+			fmt.Sprintf("service %s is denied: %v", owner, err))
+	}
+
+	return reviewResponse
+}
+
+func deny(reviewResponse *v1.AdmissionResponse, reason metav1.StatusReason, msg string) *v1.AdmissionResponse {
+	klog.V(2).Info(msg)
+	reviewResponse.Allowed = false
+	reviewResponse.Result = &metav1.Status{
+		Status:  metav1.StatusFailure,
+		Reason:  reason,
+		Message: msg,
+	}
+	return reviewResponse
+}
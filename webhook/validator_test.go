@@ -0,0 +1,93 @@
+package webhook
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/tiggoins/port-allocator/store"
+	v1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestValidateService(t *testing.T) {
+	unmanaged := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 31000))
+	foreign := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30105))
+	inRange := newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30001))
+	withUnmanaged := inRange.DeepCopy()
+	withUnmanaged.Spec.Ports = append(withUnmanaged.Spec.Ports, servicePort("extra", 81, corev1.ProtocolTCP, 31000))
+
+	tests := []struct {
+		name       string
+		setup      func(t *testing.T, s *store.NamespaceNodePortConfig)
+		op         v1.Operation
+		oldService *corev1.Service
+		service    *corev1.Service
+		// wantDenied is a part of the denial message, empty when the request is allowed
+		wantDenied string
+	}{
+		{
+			name:  "update keeps an unmanaged port",
+			setup: hold("a", 31000),
+			op:    v1.Update, oldService: unmanaged, service: withLabel(unmanaged),
+		},
+		{
+			name:  "update keeps a foreign port held by the service",
+			setup: hold("a", 30105),
+			op:    v1.Update, oldService: foreign, service: withLabel(foreign),
+		},
+		{
+			name:       "create with an out of range port",
+			op:         v1.Create,
+			service:    unmanaged,
+			wantDenied: "nodePort 31000 of service ns/a is out of range, namespace ns only allows nodePorts 30000-30010",
+		},
+		{
+			name:       "update adding an out of range port",
+			setup:      hold("a", 30001),
+			op:         v1.Update,
+			oldService: inRange, service: withUnmanaged,
+			wantDenied: "nodePort 31000 of service ns/a is out of range",
+		},
+		{
+			name:       "create with a port held by another service",
+			setup:      hold("b", 30001),
+			op:         v1.Create,
+			service:    inRange,
+			wantDenied: "nodePort 30001 of service ns/a is already allocated to ns/b",
+		},
+		{
+			name: "update adding a reserved port",
+			setup: func(t *testing.T, s *store.NamespaceNodePortConfig) {
+				if err := s.SetReserved("", store.PortRanges{{Min: 30001, Max: 30001}}); err != nil {
+					t.Fatal(err)
+				}
+			},
+			op:         v1.Update,
+			oldService: newService("a", servicePort("http", 80, corev1.ProtocolTCP, 30002)), service: inRange,
+			wantDenied: "nodePort 30001 of service ns/a is reserved",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			if tt.setup != nil {
+				tt.setup(t, s)
+			}
+
+			resp := NewValidator(s).validateService(newReview(t, tt.op, tt.oldService, tt.service, false))
+			if tt.wantDenied == "" {
+				if !resp.Allowed {
+					t.Fatalf("request denied: %s", resp.Result.Message)
+				}
+				return
+			}
+			if resp.Allowed {
+				t.Fatalf("request allowed, want it denied with %q", tt.wantDenied)
+			}
+			if !strings.Contains(resp.Result.Message, tt.wantDenied) {
+				t.Errorf("request denied with %q, want %q", resp.Result.Message, tt.wantDenied)
+			}
+		})
+	}
+}